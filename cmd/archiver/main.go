@@ -14,6 +14,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	flags "github.com/jessevdk/go-flags"
@@ -23,7 +24,6 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/jeks313/activemq-archiver/internal/archive"
 	"github.com/jeks313/activemq-archiver/internal/consumer"
-	"github.com/jeks313/activemq-archiver/internal/content"
 	"github.com/jeks313/activemq-archiver/pkg/options"
 	"github.com/jeks313/activemq-archiver/pkg/server"
 	"github.com/rs/zerolog"
@@ -31,20 +31,87 @@ import (
 
 var opts struct {
 	ActiveMQ    ActivemqOpts               `group:"ActiveMQ Options"`
+	Upload      UploadOpts                 `group:"Upload Options"`
 	Service     options.ServiceOptions     `group:"Default Service Options"`
 	Application options.ApplicationOptions `group:"Default Application Server Options"`
 	// local options here
-	Port int `long:"port" env:"PORT" description:"application port" default:"8080"`
+	Port            int           `long:"port" env:"PORT" description:"application port" default:"8080"`
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" description:"how long to wait for the consumer to stop and uploads to finish on shutdown" default:"25s"`
 }
 
 // ActivemqOpts command line options for activemq
 type ActivemqOpts struct {
-	Topic       string   `long:"topic" env:"TOPIC" description:"topic to archive" required:"true"`
-	Hostname    string   `long:"activemq" env:"ACTIVE_MQ" description:"activemq hostname" default:"localhost:61613"`
-	ArchivePath string   `long:"archive-path" env:"ARCHIVE_PATH" default:"/var/lib/activemq-archive" description:"base directory to write archive files"`
-	Key         string   `long:"key" env:"TOPIC_KEY" description:"key to look for in the document to use to construct archive filename" required:"true"`
-	MaxSize     int      `long:"max-size" env:"MAX_ARCHIVE_SIZE" description:"maximum archive size, defaults to 32M for athena usage in S3" default:"33554432"`
-	Headers     []string `long:"header" env:"ACTIVEMQ_HEADERS" description:"headers to include from activemq into the payload" default:"accountUid" default:"deviceIdentity" default:"deviceUid" default:"esn" default:"x-Content-Type" env-delim:","`
+	Topics           []string      `long:"topic" env:"TOPIC" env-delim:" " description:"topic to archive, repeat for several topics, NAME?key=deviceUid&headers=esn,deviceUid&handlers=zip;json&archive-path=/dir&complete-path=/dir overrides those settings for the topic"`
+	Config           string        `long:"config" env:"CONFIG" description:"YAML file defining the pipelines to run instead of --topic, settings a pipeline leaves out come from the command line"`
+	CheckConfig      bool          `long:"check-config" description:"validate the pipelines from --config or --topic and exit"`
+	Subscription     string        `long:"subscription" env:"SUBSCRIPTION" description:"what topics subscribe to, virtual-topic subscribes to /queue/Consumer.<consumer-name>.VirtualTopic.<topic>, queue to /queue/<topic>, durable-topic to /topic/<topic> with a durable subscription, topics can use the * and > wildcards" default:"virtual-topic" choice:"virtual-topic" choice:"queue" choice:"durable-topic"`
+	Consumer         string        `long:"consumer-name" env:"CONSUMER_NAME" description:"virtual topic consumer name, give each environment its own so they don't take each other's messages" default:"Archive"`
+	ClientID         string        `long:"client-id" env:"CLIENT_ID" description:"client-id for durable-topic connections, the topic is appended as each topic has its own connection, keep it the same across restarts" default:"activemq-archiver"`
+	SubscriptionName string        `long:"subscription-name" env:"SUBSCRIPTION_NAME" description:"durable subscription name for durable-topic" default:"Archive"`
+	Hostname         string        `long:"activemq" env:"ACTIVE_MQ" description:"activemq hostname, stomp+ssl://host:port connects with TLS, failover:(host:port,host:port)?randomize=false tries several" default:"localhost:61613"`
+	FailoverOrder    string        `long:"failover-order" env:"FAILOVER_ORDER" description:"how the next broker in a failover list is picked, randomize in the failover url overrides it" default:"random" choice:"random" choice:"ordered"`
+	ReconnectDelay   time.Duration `long:"reconnect-delay" env:"RECONNECT_DELAY" description:"delay before reconnecting, doubled by --reconnect-multiplier with every failed attempt" default:"1s"`
+	ReconnectMax     time.Duration `long:"reconnect-max-delay" env:"RECONNECT_MAX_DELAY" description:"longest delay between attempts to reconnect" default:"30s"`
+	ReconnectFactor  float64       `long:"reconnect-multiplier" env:"RECONNECT_MULTIPLIER" description:"how much the delay grows with each failed attempt" default:"2"`
+	ReconnectJitter  float64       `long:"reconnect-jitter" env:"RECONNECT_JITTER" description:"fraction of the delay added or taken off at random" default:"0.2"`
+	HeartBeatSend    time.Duration `long:"heartbeat-send" env:"HEARTBEAT_SEND" description:"how often to send the broker heartbeats on idle connections, 0 is never" default:"10s"`
+	HeartBeatReceive time.Duration `long:"heartbeat-receive" env:"HEARTBEAT_RECEIVE" description:"how often to ask the broker for heartbeats on idle connections, 0 is never" default:"10s"`
+	ConnectTimeout   time.Duration `long:"connect-timeout" env:"CONNECT_TIMEOUT" description:"how long connecting to a broker may take before trying the next one" default:"10s"`
+	ReadTimeout      time.Duration `long:"read-timeout" env:"READ_TIMEOUT" description:"also reconnect when nothing, not even a heartbeat, is read from the broker for this long, by default only the heartbeats the broker agreed to send are checked"`
+	Login            string        `long:"activemq-login" env:"ACTIVEMQ_LOGIN" description:"login to connect with"`
+	LoginFile        string        `long:"activemq-login-file" env:"ACTIVEMQ_LOGIN_FILE" description:"file holding the login, overrides --activemq-login"`
+	Passcode         string        `long:"activemq-passcode" env:"ACTIVEMQ_PASSCODE" description:"passcode to connect with"`
+	PasscodeFile     string        `long:"activemq-passcode-file" env:"ACTIVEMQ_PASSCODE_FILE" description:"file holding the passcode, overrides --activemq-passcode"`
+	VHost            string        `long:"activemq-vhost" env:"ACTIVEMQ_VHOST" description:"virtual host sent in the host header on connect"`
+	CAFile           string        `long:"activemq-ca-file" env:"ACTIVEMQ_CA_FILE" description:"PEM bundle of the CAs to verify the broker certificate with for stomp+ssl, defaults to the system roots"`
+	CertFile         string        `long:"activemq-cert-file" env:"ACTIVEMQ_CERT_FILE" description:"PEM client certificate for stomp+ssl brokers that require one"`
+	KeyFile          string        `long:"activemq-key-file" env:"ACTIVEMQ_KEY_FILE" description:"PEM key of the client certificate"`
+	ServerName       string        `long:"activemq-server-name" env:"ACTIVEMQ_SERVER_NAME" description:"name the broker certificate must have, defaults to the broker hostname"`
+	ArchivePath      string        `long:"archive-path" env:"ARCHIVE_PATH" default:"/var/lib/activemq-archive" description:"base directory to write archive files"`
+	CompletePath     string        `long:"complete-path" env:"COMPLETE_PATH" description:"directory completed archive files are moved to, files are written as .tmp in the archive path until then, must be on the same filesystem"`
+	Key              string        `long:"key" env:"TOPIC_KEY" description:"key to look for in the document to use to construct archive filename, required unless every pipeline in --config sets it"`
+	MaxSize          int           `long:"max-size" env:"MAX_ARCHIVE_SIZE" description:"maximum archive size, defaults to 32M for athena usage in S3" default:"33554432"`
+	Headers          []string      `long:"header" env:"ACTIVEMQ_HEADERS" description:"headers to include from activemq into the payload" default:"accountUid" default:"deviceIdentity" default:"deviceUid" default:"esn" default:"x-Content-Type" env-delim:","`
+	Layout           string        `long:"layout" env:"ARCHIVE_LAYOUT" description:"archive file naming, flat puts everything in the filename, hive creates topic=/dt=/hour=/accountUID= partition directories" default:"flat" choice:"flat" choice:"hive"`
+	Template         string        `long:"filename-template" env:"ARCHIVE_FILENAME_TEMPLATE" description:"go text/template for archive filenames relative to the archive path, overrides --layout, the extension is added automatically"`
+	Format           string        `long:"format" env:"ARCHIVE_FORMAT" description:"archive file format, json writes newline delimited JSON, parquet writes a columnar file per rotation" default:"json" choice:"json" choice:"parquet"`
+	TimeSource       string        `long:"time-source" env:"TIME_SOURCE" description:"where the time used to partition archives by hour comes from, arrival time, a payload field or a message header" default:"arrival" choice:"arrival" choice:"payload" choice:"header"`
+	TimePath         string        `long:"time-path" env:"TIME_PATH" description:"JSON path of the event time in the payload for --time-source=payload"`
+	TimeHeader       string        `long:"time-header" env:"TIME_HEADER" description:"header holding the event time for --time-source=header" default:"timestamp"`
+	TimeLayout       string        `long:"time-layout" env:"TIME_LAYOUT" description:"layout of the event time, unix, unixms or a go time layout, defaults to RFC3339 for the payload and unixms for the header"`
+	Lateness         time.Duration `long:"lateness" env:"LATENESS" description:"how long after the end of an hour its archives are kept open for late events" default:"0s"`
+	ClockSkew        time.Duration `long:"clock-skew" env:"CLOCK_SKEW" description:"how far ahead of the clock event times may be, later ones are archived under their arrival time" default:"5m"`
+	IdleTimeout      time.Duration `long:"idle-timeout" env:"IDLE_TIMEOUT" description:"close archives that have not been written to for this long, 0 keeps them open until the end of their hour" default:"0s"`
+	MaxOpen          int           `long:"max-open-files" env:"MAX_OPEN_FILES" description:"most archive files kept open at once, the least recently written are closed and reopened when written to again, 0 is unlimited" default:"0"`
+	MaxBuffered      int           `long:"max-buffered" env:"MAX_BUFFERED" description:"most bytes parquet archives under an archive path buffer in memory, the least recently written are closed early past this, 0 is unlimited" default:"0"`
+	PublishOrphans   bool          `long:"publish-orphans" env:"PUBLISH_ORPHANS" description:"on start publish archive files left by a previous run for hours that are over, instead of leaving them in the archive path"`
+	ReapInterval     time.Duration `long:"reap-interval" env:"REAP_INTERVAL" description:"how often open archives are checked for the end of their hour and idleness" default:"10s"`
+	AckPolicy        string        `long:"ack-policy" env:"ACK_POLICY" description:"when messages are acked, write acks once written to the page cache, the others wait for the archive to be synced to disk every message, every --ack-count messages, every --ack-interval or on rotation" default:"write" choice:"write" choice:"message" choice:"count" choice:"interval" choice:"rotation"`
+	AckCount         int           `long:"ack-count" env:"ACK_COUNT" description:"messages between syncs with --ack-policy=count" default:"100"`
+	AckInterval      time.Duration `long:"ack-interval" env:"ACK_INTERVAL" description:"time between syncs with --ack-policy=interval, and how often closed archives are checked for messages to ack with the other policies" default:"1s"`
+	AckMode          string        `long:"ack-mode" env:"ACK_MODE" description:"how deferred acks are sent, client-individual acks every message in a transaction, client sends one cumulative ack" default:"client-individual" choice:"client-individual" choice:"client"`
+	Workers          int           `long:"workers" env:"WORKERS" description:"messages decoded at once per topic, they are still written and acked in the order they arrived" default:"1"`
+	Prefetch         int           `long:"activemq-prefetch" env:"ACTIVEMQ_PREFETCH" description:"unacked messages the broker sends each subscription before waiting for acks, sent as activemq.prefetchSize, 0 is the broker default"`
+	DeadLetter       string        `long:"dead-letter-destination" env:"DEAD_LETTER_DESTINATION" description:"broker destination messages that can't be converted are forwarded to with the failure reason in headers, e.g. /queue/DLQ.Archive.MyTopic"`
+	QuarantinePath   string        `long:"quarantine-path" env:"QUARANTINE_PATH" description:"directory messages that can't be converted are archived to, raw and base64 encoded, partitioned by failure reason"`
+	Compression      string        `long:"compression" env:"ARCHIVE_COMPRESSION" description:"compression for archive files, gzip writes athena readable .log.gz files, zstd writes .log.zst files" default:"none" choice:"none" choice:"gzip" choice:"zstd"`
+	Level            int           `long:"compression-level" env:"ARCHIVE_COMPRESSION_LEVEL" description:"compression level, 1-9 for gzip and 1-22 for zstd, 0 uses the default level"`
+}
+
+// UploadOpts command line options for uploading completed archives to S3
+type UploadOpts struct {
+	Bucket      string        `long:"s3-bucket" env:"S3_BUCKET" description:"bucket to upload completed archives to, uploading is disabled when empty"`
+	Prefix      string        `long:"s3-prefix" env:"S3_PREFIX" description:"key prefix, the archive filename is appended"`
+	Endpoint    string        `long:"s3-endpoint" env:"S3_ENDPOINT" description:"S3 compatible endpoint, defaults to AWS"`
+	Region      string        `long:"s3-region" env:"S3_REGION" description:"bucket region" default:"us-east-1"`
+	AccessKey   string        `long:"s3-access-key" env:"S3_ACCESS_KEY" description:"access key, defaults to the AWS credential chain"`
+	SecretKey   string        `long:"s3-secret-key" env:"S3_SECRET_KEY" description:"secret key"`
+	PathStyle   bool          `long:"s3-path-style" env:"S3_PATH_STYLE" description:"use path style addressing, needed by most S3 compatible stores"`
+	PartSize    int64         `long:"s3-part-size" env:"S3_PART_SIZE" description:"multipart upload part size, minimum 5MB" default:"5242880"`
+	Retries     int           `long:"s3-retries" env:"S3_RETRIES" description:"upload attempts per file" default:"5"`
+	RetryDelay  time.Duration `long:"s3-retry-delay" env:"S3_RETRY_DELAY" description:"delay before retrying a failed upload, doubled each attempt" default:"1s"`
+	AfterUpload string        `long:"s3-after-upload" env:"S3_AFTER_UPLOAD" description:"what to do with the local file after a verified upload" default:"delete" choice:"delete" choice:"move" choice:"keep"`
+	MovePath    string        `long:"s3-move-path" env:"S3_MOVE_PATH" description:"directory uploaded files are moved to with --s3-after-upload=move"`
 }
 
 func main() {
@@ -69,13 +136,66 @@ func main() {
 		os.Exit(0)
 	}
 
-	if _, err := os.Stat(opts.ActiveMQ.ArchivePath); os.IsNotExist(err) {
-		log.Error().Err(err).Str("archive_path", opts.ActiveMQ.ArchivePath).Msg("output path does not exist")
+	// set config from default environment variables / config files
+	options.Environment(opts.Application.Environment)
+
+	defaults := topicSpec{
+		Subscription:     opts.ActiveMQ.Subscription,
+		Consumer:         opts.ActiveMQ.Consumer,
+		SubscriptionName: opts.ActiveMQ.SubscriptionName,
+		Key:              opts.ActiveMQ.Key,
+		Headers:          opts.ActiveMQ.Headers,
+		ArchivePath:      opts.ActiveMQ.ArchivePath,
+		CompletePath:     opts.ActiveMQ.CompletePath,
+		Time: timeSpec{
+			Source: opts.ActiveMQ.TimeSource,
+			Path:   opts.ActiveMQ.TimePath,
+			Header: opts.ActiveMQ.TimeHeader,
+			Layout: opts.ActiveMQ.TimeLayout,
+		},
+		Sink: sinkSpec{
+			Layout:      opts.ActiveMQ.Layout,
+			Template:    opts.ActiveMQ.Template,
+			Format:      opts.ActiveMQ.Format,
+			Compression: opts.ActiveMQ.Compression,
+			Level:       opts.ActiveMQ.Level,
+			MaxSize:     opts.ActiveMQ.MaxSize,
+		},
+	}
+	specs, err := loadSpecs(opts.ActiveMQ.Config, opts.ActiveMQ.Topics, defaults)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid pipelines")
 		os.Exit(1)
 	}
 
-	// set config from default environment variables / config files
-	options.Environment(opts.Application.Environment)
+	ackPolicy, err := consumer.ParseAckPolicy(opts.ActiveMQ.AckPolicy)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid ack policy")
+		os.Exit(1)
+	}
+	if opts.ActiveMQ.Workers < 1 || opts.ActiveMQ.Prefetch < 0 {
+		log.Error().Int("workers", opts.ActiveMQ.Workers).Int("prefetch", opts.ActiveMQ.Prefetch).Msg("need at least one worker and a prefetch of 0 or more")
+		os.Exit(1)
+	}
+	acks := ackSettings{Policy: ackPolicy, Count: opts.ActiveMQ.AckCount, Prefetch: opts.ActiveMQ.Prefetch}
+	if err := checkAcks(acks); err != nil {
+		log.Error().Err(err).Str("ack_policy", ackPolicy).Msg("invalid ack settings")
+		os.Exit(1)
+	}
+	if opts.Upload.Bucket != "" {
+		if err := checkUploads(specs, opts.ActiveMQ.PublishOrphans); err != nil {
+			log.Error().Err(err).Msg("invalid upload settings")
+			os.Exit(1)
+		}
+	}
+
+	if opts.ActiveMQ.CheckConfig {
+		for _, spec := range specs {
+			log.Info().Str("topic", spec.Topic).Str("key", spec.Key).Strs("handlers", spec.Handlers).Str("archive_path", spec.ArchivePath).Msg("pipeline ok")
+		}
+		log.Info().Int("pipelines", len(specs)).Msg("config is valid")
+		os.Exit(0)
+	}
 
 	// define router:
 	r := mux.NewRouter()
@@ -103,9 +223,6 @@ func main() {
 	// log
 	server.LogHandler(r, "/log", 5000)
 
-	// setup health with dependencies.
-	server.Health(r, "/status/")
-
 	// Not found if you want to customize
 	r.NotFoundHandler = r.NewRoute().HandlerFunc(http.NotFound).GetHandler()
 
@@ -122,64 +239,106 @@ func main() {
 	ctx, cancel := context.WithCancel(ctx)
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	defer func() {
 		signal.Stop(c)
 		cancel()
 	}()
 
-	a := archive.New(opts.ActiveMQ.MaxSize)
-	a.Path = opts.ActiveMQ.ArchivePath
-
-	q := consumer.New()
-	q.Hostname = opts.ActiveMQ.Hostname
-	q.Topic = opts.ActiveMQ.Topic
-	q.Key = opts.ActiveMQ.Key
-	q.Ctx = ctx
-	q.ContentTypeHeader = "x-content-type"
-	q.Handlers["zip;json"] = content.HandlerFromZipJSON
-	q.Handlers["b64;zip;json"] = content.HandlerFromBase64ZipJSON
-	q.Headers = opts.ActiveMQ.Headers
-
-	// main activemq consumer loop, reconnects with 2 sec delay
-	go func() {
-		var err error
-		for {
-			log.Info().Str("hostname", opts.ActiveMQ.Hostname).Msg("activemq: connecting")
-			err = q.Connect(opts.ActiveMQ.Hostname)
-			if err != nil {
-				log.Error().Err(err).Str("hostname", opts.ActiveMQ.Hostname).Msg("failed to connect to activemq")
-				continue
-			}
-
-			log.Info().Str("hostname", opts.ActiveMQ.Hostname).Str("topic", opts.ActiveMQ.Topic).Msg("activemq: subscribing")
-			err = q.Subscribe(opts.ActiveMQ.Topic)
-			if err != nil {
-				log.Error().Err(err).Str("topic", opts.ActiveMQ.Topic).Msg("unable to subscribe to topic")
-				continue
-			}
+	uploadCtx, uploadCancel := context.WithCancel(context.Background())
+	defer uploadCancel()
 
-			log.Info().Str("hostname", opts.ActiveMQ.Hostname).Str("topic", opts.ActiveMQ.Topic).Msg("activemq: consuming")
-			err = q.Consume(a)
+	var quarantine *archive.Archives
+	if opts.ActiveMQ.QuarantinePath != "" {
+		if _, err := os.Stat(opts.ActiveMQ.QuarantinePath); os.IsNotExist(err) {
+			log.Error().Err(err).Str("quarantine_path", opts.ActiveMQ.QuarantinePath).Msg("quarantine path does not exist")
+			os.Exit(1)
+		}
+		settings := defaults
+		settings.ArchivePath = opts.ActiveMQ.QuarantinePath
+		settings.CompletePath = ""
+		settings.Key = "reason"
+		settings.Sink.Template = ""
+		settings.Sink.Format = string(archive.FormatJSON)
+		quarantine, err = settings.archives()
+		if err != nil {
+			log.Error().Err(err).Msg("invalid quarantine settings")
+			os.Exit(1)
+		}
+		err = quarantine.Recover(opts.ActiveMQ.PublishOrphans)
+		if err != nil {
+			log.Error().Err(err).Str("archive_path", quarantine.Path).Msg("failed to recover archives from a previous run")
+			os.Exit(1)
+		}
+		go quarantine.Reap(ctx, opts.ActiveMQ.ReapInterval, opts.ActiveMQ.IdleTimeout)
+	}
 
-			if err != nil {
-				log.Error().Err(err).Msg("consumer ended")
-			}
+	// topics writing to the same archive path share its archives, so there's a single writer per file
+	// and a single open file limit, and an uploader for the directory the completed files end up in
+	s := newSupervisor(ctx, uploadCtx, defaults, ackPolicy)
+	s.quarantine = quarantine
+	s.failover = consumer.Failover{
+		Randomize:  opts.ActiveMQ.FailoverOrder == "random",
+		Delay:      opts.ActiveMQ.ReconnectDelay,
+		MaxDelay:   opts.ActiveMQ.ReconnectMax,
+		Multiplier: opts.ActiveMQ.ReconnectFactor,
+		Jitter:     opts.ActiveMQ.ReconnectJitter,
+	}
+	_, err = consumer.ParseFailover(opts.ActiveMQ.Hostname, s.failover)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid activemq address")
+		os.Exit(1)
+	}
+	s.login, err = options.Secret(opts.ActiveMQ.Login, opts.ActiveMQ.LoginFile)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read activemq login")
+		os.Exit(1)
+	}
+	s.passcode, err = options.Secret(opts.ActiveMQ.Passcode, opts.ActiveMQ.PasscodeFile)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read activemq passcode")
+		os.Exit(1)
+	}
+	s.tls, err = consumer.TLSOptions{
+		CAFile:     opts.ActiveMQ.CAFile,
+		CertFile:   opts.ActiveMQ.CertFile,
+		KeyFile:    opts.ActiveMQ.KeyFile,
+		ServerName: opts.ActiveMQ.ServerName,
+	}.Config()
+	if err != nil {
+		log.Error().Err(err).Msg("invalid activemq tls settings")
+		os.Exit(1)
+	}
+	_, err = s.Apply(specs)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to start pipelines")
+		os.Exit(1)
+	}
+	s.ReloadHandler(r, "/admin/reload")
 
-			log.Info().Msg("waiting to re-connect...")
-			time.Sleep(2 * time.Second)
-		}
-	}()
+	// setup health with dependencies, and how each topic is subscribed to
+	server.Health(r, "/status/", map[string]interface{}{"subscriptions": server.Dynamic(s.Subscriptions)})
 
 	go func() {
-		select {
-		case <-c:
-			cancel()
-			log.Info().Msg("shutting down http listener ...")
-			srv.Shutdown(ctx)
-		case <-ctx.Done():
+		for {
+			select {
+			case sig := <-c:
+				if sig == syscall.SIGHUP {
+					log.Info().Str("signal", sig.String()).Msg("reloading config")
+					s.Reload() // logs the changes and why it failed
+					continue
+				}
+				log.Info().Str("signal", sig.String()).Msg("shutting down")
+				cancel()
+			case <-ctx.Done():
+			}
+			break
 		}
+		log.Info().Msg("shutting down http listener ...")
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		srv.Shutdown(shutdownCtx)
 	}()
 
 	log.Info().Int("port", opts.Port).Msg("starting listening server")
@@ -190,6 +349,28 @@ func main() {
 		log.Error().Err(err).Msg("failed to start http server")
 		os.Exit(1)
 	}
+	cancel()
+
+	timeout := time.After(opts.ShutdownTimeout)
+	s.Shutdown(opts.ShutdownTimeout)
+
+	uploaders := s.Uploaders()
+	if len(uploaders) > 0 {
+		log.Info().Msg("waiting for uploads to finish ...")
+		uploadCancel()
+		uploaded := make(chan struct{})
+		go func() {
+			for _, uploader := range uploaders {
+				uploader.Wait()
+			}
+			close(uploaded)
+		}()
+		select {
+		case <-uploaded:
+		case <-timeout:
+			log.Error().Dur("timeout", opts.ShutdownTimeout).Msg("timed out waiting for uploads to finish")
+		}
+	}
 
 	log.Info().Msg("stopped")
 }
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jeks313/activemq-archiver/internal/archive"
+	"github.com/jeks313/activemq-archiver/internal/consumer"
+	"github.com/jeks313/activemq-archiver/internal/content"
+	"github.com/jeks313/activemq-archiver/pkg/options"
+)
+
+// contentDecoder composes the decoder for an x-content-type chain, e.g. b64;gzip;json
+func contentDecoder(contentType string) (consumer.ContentTypeHandler, error) {
+	decode, err := content.Parse(contentType)
+	if err != nil {
+		return nil, err
+	}
+	return consumer.ContentTypeHandler(decode), nil
+}
+
+// checkHandlers checks the content types a topic is limited to can be decoded
+func checkHandlers(topic string, handlers []string) error {
+	for _, h := range handlers {
+		if _, err := content.Parse(h); err != nil {
+			return fmt.Errorf("topic %v: content handler: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// topicSpec is a topic to archive and the settings it can override, from the command line as NAME or
+// NAME?key=deviceUid&headers=esn,deviceUid&handlers=zip;json&archive-path=/data/devices&complete-path=/data/complete,
+// with subscription=virtual-topic|queue|durable-topic, consumer=NAME, client-id=ID and subscription-name=NAME
+// to change the destination subscribed to, without handlers any content type chain is decoded
+type topicSpec struct {
+	Topic            string
+	Subscription     string
+	Consumer         string
+	ClientID         string
+	SubscriptionName string
+	Key              string
+	Headers          []string
+	Handlers         []string
+	ArchivePath      string
+	CompletePath     string
+	Time             timeSpec
+	Sink             sinkSpec
+}
+
+// timeSpec is where the time a topic's documents are archived under comes from
+type timeSpec struct {
+	Source string
+	Path   string
+	Header string
+	Layout string
+}
+
+// sinkSpec is how the archive files for an archive path are written, topics sharing a path must agree on it
+type sinkSpec struct {
+	Layout      string
+	Template    string
+	Format      string
+	Compression string
+	Level       int
+	MaxSize     int
+}
+
+// parseTopicSpec parses a --topic value, settings it doesn't give come from defaults
+func parseTopicSpec(s string, defaults topicSpec) (topicSpec, error) {
+	spec := defaults
+	name, settings := s, ""
+	if i := strings.Index(s, "?"); i >= 0 {
+		name, settings = s[:i], s[i+1:]
+	}
+	spec.Topic = strings.TrimSpace(name)
+	if spec.Topic == "" {
+		return spec, fmt.Errorf("topic name missing from %q", s)
+	}
+	if settings == "" {
+		return spec, nil
+	}
+	for _, setting := range strings.Split(settings, "&") {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return spec, fmt.Errorf("topic %v: setting %q needs a value", spec.Topic, setting)
+		}
+		switch kv[0] {
+		case "key":
+			spec.Key = kv[1]
+		case "headers":
+			spec.Headers = strings.Split(kv[1], ",")
+		case "handlers":
+			spec.Handlers = strings.Split(kv[1], ",")
+			if err := checkHandlers(spec.Topic, spec.Handlers); err != nil {
+				return spec, err
+			}
+		case "subscription":
+			spec.Subscription = kv[1]
+		case "consumer":
+			spec.Consumer = kv[1]
+		case "client-id":
+			spec.ClientID = kv[1]
+		case "subscription-name":
+			spec.SubscriptionName = kv[1]
+		case "archive-path":
+			spec.ArchivePath = kv[1]
+		case "complete-path":
+			spec.CompletePath = kv[1]
+		default:
+			return spec, fmt.Errorf("topic %v: unknown setting %q", spec.Topic, kv[0])
+		}
+	}
+	return spec, nil
+}
+
+// loadSpecs gets the topics to archive from the config file when given, otherwise from the --topic values
+func loadSpecs(config string, topics []string, defaults topicSpec) ([]topicSpec, error) {
+	var specs []topicSpec
+	if config != "" {
+		if len(topics) > 0 {
+			return nil, fmt.Errorf("--topic and --config can't be used together")
+		}
+		c, err := options.LoadConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range c.Pipelines {
+			spec, err := specFromPipeline(p, defaults)
+			if err != nil {
+				return nil, fmt.Errorf("pipeline %v: %w", p.Name, err)
+			}
+			specs = append(specs, spec)
+		}
+	} else {
+		if len(topics) == 0 {
+			return nil, fmt.Errorf("either --topic or --config is required")
+		}
+		for _, t := range topics {
+			spec, err := parseTopicSpec(t, defaults)
+			if err == nil {
+				err = spec.validate()
+			}
+			if err != nil {
+				return nil, err
+			}
+			specs = append(specs, spec)
+		}
+	}
+	return specs, checkSpecs(specs)
+}
+
+// checkSpecs checks topics aren't consumed twice, durable subscriptions don't share a client id, and topics sharing an archive path agree on how it is written
+func checkSpecs(specs []topicSpec) error {
+	seen := make(map[string]bool)
+	clientIDs := make(map[string]string)
+	paths := make(map[string]topicSpec)
+	for _, spec := range specs {
+		if seen[spec.Topic] {
+			return fmt.Errorf("topic %v: given more than once", spec.Topic)
+		}
+		seen[spec.Topic] = true
+		if spec.Subscription == consumer.SubscriptionDurable {
+			if other, ok := clientIDs[spec.clientID()]; ok {
+				return fmt.Errorf("topic %v: client id %v is already used by topic %v, activemq allows one connection per client id", spec.Topic, spec.clientID(), other)
+			}
+			clientIDs[spec.clientID()] = spec.Topic
+		}
+		other, ok := paths[spec.ArchivePath]
+		if !ok {
+			paths[spec.ArchivePath] = spec
+			continue
+		}
+		if other.CompletePath != spec.CompletePath || other.Sink != spec.Sink {
+			return fmt.Errorf("topic %v: topics sharing archive path %v with %v must share its complete path and sink settings", spec.Topic, spec.ArchivePath, other.Topic)
+		}
+	}
+	return nil
+}
+
+// ackSettings is how messages are acked, checked by checkAcks
+type ackSettings struct {
+	Policy   string
+	Count    int
+	Prefetch int
+}
+
+// checkAcks rejects ack settings that would stall delivery once the broker's prefetch limit of unacked messages is reached
+func checkAcks(acks ackSettings) error {
+	if acks.Prefetch > 0 && acks.Policy == consumer.AckPolicyCount && acks.Prefetch < acks.Count {
+		return fmt.Errorf("the prefetch of %d must be at least the ack count of %d", acks.Prefetch, acks.Count)
+	}
+	return nil
+}
+
+// checkUploads rejects uploading from an archive path where files missed on shutdown wouldn't be found
+// again, they are only queued on start when they are in a complete path or published as orphans
+func checkUploads(specs []topicSpec, publishOrphans bool) error {
+	if publishOrphans {
+		return nil
+	}
+	for _, spec := range specs {
+		if spec.CompletePath == "" {
+			return fmt.Errorf("topic %v: uploading needs --complete-path or --publish-orphans so files not uploaded before a shutdown are uploaded on start", spec.Topic)
+		}
+	}
+	return nil
+}
+
+// specFromPipeline converts a config file pipeline, settings it leaves out come from defaults
+func specFromPipeline(p options.Pipeline, defaults topicSpec) (topicSpec, error) {
+	spec := defaults
+	spec.Topic = p.Source.Destination
+	if p.Source.Subscription != "" {
+		spec.Subscription = p.Source.Subscription
+	}
+	if p.Source.Consumer != "" {
+		spec.Consumer = p.Source.Consumer
+	}
+	if p.Source.ClientID != "" {
+		spec.ClientID = p.Source.ClientID
+	}
+	if p.Source.SubscriptionName != "" {
+		spec.SubscriptionName = p.Source.SubscriptionName
+	}
+	if p.Key != "" {
+		spec.Key = p.Key
+	}
+	if len(p.Headers) > 0 {
+		spec.Headers = p.Headers
+	}
+	if len(p.Handlers) > 0 {
+		spec.Handlers = p.Handlers
+	}
+	if t := p.Transforms.Time; t != nil {
+		spec.Time = timeSpec{Source: t.Source, Path: t.Path, Header: t.Header, Layout: t.Layout}
+		if spec.Time.Header == "" {
+			spec.Time.Header = defaults.Time.Header
+		}
+	}
+	if p.Sink.ArchivePath != "" {
+		spec.ArchivePath = p.Sink.ArchivePath
+	}
+	if p.Sink.CompletePath != "" {
+		spec.CompletePath = p.Sink.CompletePath
+	}
+	if p.Sink.Layout != "" {
+		spec.Sink.Layout = p.Sink.Layout
+	}
+	if p.Sink.FilenameTemplate != "" {
+		spec.Sink.Template = p.Sink.FilenameTemplate
+	}
+	if p.Sink.Format != "" {
+		spec.Sink.Format = p.Sink.Format
+	}
+	if p.Sink.Compression != "" {
+		spec.Sink.Compression = p.Sink.Compression
+	}
+	if p.Sink.CompressionLevel != 0 {
+		spec.Sink.Level = p.Sink.CompressionLevel
+	}
+	if p.Sink.MaxSize != 0 {
+		spec.Sink.MaxSize = p.Sink.MaxSize
+	}
+	return spec, spec.validate()
+}
+
+// validate checks the settings a topic can't start with, without touching the filesystem
+func (s topicSpec) validate() error {
+	if s.Key == "" {
+		return fmt.Errorf("topic %v: key is required", s.Topic)
+	}
+	subscription, err := consumer.ParseSubscription(s.Subscription)
+	if err != nil {
+		return fmt.Errorf("topic %v: %w", s.Topic, err)
+	}
+	if subscription == consumer.SubscriptionVirtualTopic {
+		err = consumer.ValidConsumer(s.Consumer)
+		if err != nil {
+			return fmt.Errorf("topic %v: %w", s.Topic, err)
+		}
+	}
+	if subscription == consumer.SubscriptionDurable && s.SubscriptionName == "" {
+		return fmt.Errorf("topic %v: a subscription name is required for a durable subscription", s.Topic)
+	}
+	if err := checkHandlers(s.Topic, s.Handlers); err != nil {
+		return err
+	}
+	switch s.Time.Source {
+	case "", consumer.TimeSourceArrival, consumer.TimeSourceHeader:
+	case consumer.TimeSourcePayload:
+		if s.Time.Path == "" {
+			return fmt.Errorf("topic %v: a time path is required for a payload time source", s.Topic)
+		}
+	default:
+		return fmt.Errorf("topic %v: unknown time source %q", s.Topic, s.Time.Source)
+	}
+	_, err = s.archives()
+	if err != nil {
+		return fmt.Errorf("topic %v: %w", s.Topic, err)
+	}
+	return nil
+}
+
+// clientID is the client-id a durable subscription connects with, each topic has its own connection
+// so unless the topic gives one it is the --client-id with the topic appended
+func (s topicSpec) clientID() string {
+	if s.ClientID != "" {
+		return s.ClientID
+	}
+	return opts.ActiveMQ.ClientID + "." + s.Topic
+}
+
+// timeLayout is the layout of the event time, unixms for headers unless given
+func (s topicSpec) timeLayout() string {
+	if s.Time.Layout == "" && s.Time.Source == consumer.TimeSourceHeader {
+		return consumer.TimeLayoutUnixMs
+	}
+	return s.Time.Layout
+}
+
+// archives creates the archives for the topic's archive path, the caller sets up uploading and the open file limit
+func (s topicSpec) archives() (*archive.Archives, error) {
+	layout, err := archive.ParseLayout(s.Sink.Layout)
+	if err != nil {
+		return nil, err
+	}
+	format, err := archive.ParseFormat(s.Sink.Format)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := archive.ParseCompression(s.Sink.Compression)
+	if err != nil {
+		return nil, err
+	}
+	var template *archive.FilenameTemplate
+	if s.Sink.Template != "" {
+		template, err = archive.NewFilenameTemplate(s.Sink.Template)
+		if err != nil {
+			return nil, err
+		}
+	}
+	a := archive.New(s.Sink.MaxSize)
+	a.Path = s.ArchivePath
+	a.CompletePath = s.CompletePath
+	a.Layout = layout
+	a.KeyName = s.Key
+	a.Template = template
+	a.Format = format
+	a.Compression = compression
+	a.Level = s.Sink.Level
+	return a, nil
+}
+
+// pipeline consumes a single topic into the archives for its archive path
+type pipeline struct {
+	spec   topicSpec // owned by the supervisor, the consumer has its own copy of the settings
+	queue  *consumer.Queue
+	sink   *archive.Archives
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// stopped is whether the consumer has stopped, so what it wrote can be acked and its connection closed
+func (p *pipeline) stopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// reconfigure applies the topic's conversion settings to the consumer, taking effect from the next message
+func (p *pipeline) reconfigure(spec topicSpec) {
+	p.spec = spec
+	p.queue.Reconfigure(func(q *consumer.Queue) {
+		q.Key = spec.Key
+		q.Headers = spec.Headers
+		q.Handlers = make(map[string]consumer.ContentTypeHandler)
+		for _, h := range spec.Handlers {
+			q.Handlers[h], _ = contentDecoder(h) // checked by validate
+		}
+		q.Decoder = nil
+		if len(spec.Handlers) == 0 {
+			q.Decoder = contentDecoder
+		}
+		q.TimeSource = spec.Time.Source
+		q.TimePath = spec.Time.Path
+		q.TimeHeader = spec.Time.Header
+		q.TimeLayout = spec.timeLayout()
+	})
+}
+
+// run consumes the topic, reconnecting with backoff across the failover brokers until cancelled
+func (p *pipeline) run(failover *consumer.Failover) {
+	defer close(p.done)
+	p.queue.Run(failover, p.sink)
+}
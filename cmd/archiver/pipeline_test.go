@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jeks313/activemq-archiver/pkg/options"
+)
+
+func Test_parseTopicSpec(t *testing.T) {
+	defaults := topicSpec{
+		Key:         "accountUid",
+		Headers:     []string{"accountUid", "esn"},
+		ArchivePath: "/var/lib/activemq-archive",
+	}
+	tests := []struct {
+		name    string
+		spec    string
+		want    topicSpec
+		wantErr bool
+	}{
+		{
+			name: "plain topic uses the defaults",
+			spec: "DeviceEvents",
+			want: topicSpec{Topic: "DeviceEvents", Key: "accountUid", Headers: []string{"accountUid", "esn"}, ArchivePath: "/var/lib/activemq-archive"},
+		},
+		{
+			name: "overrides",
+			spec: "WebUsage?key=deviceUid&headers=deviceUid,esn,x-Content-Type&handlers=zip;json&archive-path=/data/web&complete-path=/data/complete",
+			want: topicSpec{Topic: "WebUsage", Key: "deviceUid", Headers: []string{"deviceUid", "esn", "x-Content-Type"}, Handlers: []string{"zip;json"}, ArchivePath: "/data/web", CompletePath: "/data/complete"},
+		},
+		{
+			name: "destination",
+			spec: "Legacy.>?subscription=queue&consumer=Staging",
+			want: topicSpec{Topic: "Legacy.>", Subscription: "queue", Consumer: "Staging", Key: "accountUid", Headers: []string{"accountUid", "esn"}, ArchivePath: "/var/lib/activemq-archive"},
+		},
+		{
+			name: "composed handlers",
+			spec: "WebUsage?handlers=b64;gzip;json,zstd;json",
+			want: topicSpec{Topic: "WebUsage", Key: "accountUid", Headers: []string{"accountUid", "esn"}, Handlers: []string{"b64;gzip;json", "zstd;json"}, ArchivePath: "/var/lib/activemq-archive"},
+		},
+		{
+			name:    "unknown handler",
+			spec:    "WebUsage?handlers=b64;rar;json",
+			wantErr: true,
+		},
+		{
+			name:    "unknown setting",
+			spec:    "WebUsage?path=/data",
+			wantErr: true,
+		},
+		{
+			name:    "missing value",
+			spec:    "WebUsage?key=",
+			wantErr: true,
+		},
+		{
+			name:    "missing topic",
+			spec:    "?key=deviceUid",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTopicSpec(tt.spec, defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTopicSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTopicSpec() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_specFromPipeline(t *testing.T) {
+	defaults := topicSpec{
+		Key:         "accountUid",
+		ArchivePath: "/var/lib/activemq-archive",
+		Time:        timeSpec{Source: "arrival", Header: "timestamp"},
+		Sink:        sinkSpec{Layout: "flat", Format: "json", Compression: "none", MaxSize: 1024},
+	}
+	tests := []struct {
+		name     string
+		pipeline options.Pipeline
+		want     topicSpec
+		wantErr  bool
+	}{
+		{
+			name:     "overrides",
+			pipeline: options.Pipeline{Source: options.Source{Destination: "WebUsage"}, Key: "deviceUid", Handlers: []string{"zip;json"}, Transforms: options.Transforms{Time: &options.EventTime{Source: "header"}}, Sink: options.Sink{ArchivePath: "/data/web", Compression: "zstd", CompressionLevel: 3}},
+			want:     topicSpec{Topic: "WebUsage", Key: "deviceUid", Handlers: []string{"zip;json"}, ArchivePath: "/data/web", Time: timeSpec{Source: "header", Header: "timestamp"}, Sink: sinkSpec{Layout: "flat", Format: "json", Compression: "zstd", Level: 3, MaxSize: 1024}},
+		},
+		{
+			name:     "unknown handler",
+			pipeline: options.Pipeline{Source: options.Source{Destination: "WebUsage"}, Handlers: []string{"rar;json"}},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown subscription",
+			pipeline: options.Pipeline{Source: options.Source{Destination: "WebUsage", Subscription: "mqtt"}},
+			wantErr:  true,
+		},
+		{
+			name:     "payload time without a path",
+			pipeline: options.Pipeline{Source: options.Source{Destination: "WebUsage"}, Transforms: options.Transforms{Time: &options.EventTime{Source: "payload"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown compression",
+			pipeline: options.Pipeline{Source: options.Source{Destination: "WebUsage"}, Sink: options.Sink{Compression: "lz4"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := specFromPipeline(tt.pipeline, defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("specFromPipeline() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("specFromPipeline() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	shared := []topicSpec{
+		{Topic: "DeviceEvents", ArchivePath: "/data", Sink: sinkSpec{Compression: "gzip"}},
+		{Topic: "WebUsage", ArchivePath: "/data", Sink: sinkSpec{Compression: "zstd"}},
+	}
+	if err := checkSpecs(shared); err == nil {
+		t.Errorf("expected topics sharing an archive path with different compression to be rejected")
+	}
+}
+
+func Test_checkUploads(t *testing.T) {
+	specs := []topicSpec{{Topic: "WebUsage", CompletePath: "/data/complete"}, {Topic: "DeviceEvents"}}
+	if err := checkUploads(specs, false); err == nil {
+		t.Errorf("expected uploading without a complete path to be rejected")
+	}
+	if err := checkUploads(specs, true); err != nil {
+		t.Errorf("expected uploading with orphans published to be allowed, got %v", err)
+	}
+	if err := checkUploads(specs[:1], false); err != nil {
+		t.Errorf("expected uploading from a complete path to be allowed, got %v", err)
+	}
+}
+
+func Test_checkAcks(t *testing.T) {
+	tests := []struct {
+		name    string
+		acks    ackSettings
+		wantErr bool
+	}{
+		{name: "ack on write", acks: ackSettings{Policy: "write"}},
+		{name: "interval", acks: ackSettings{Policy: "interval"}},
+		{name: "count within the prefetch", acks: ackSettings{Policy: "count", Count: 100, Prefetch: 500}},
+		{name: "count over the prefetch", acks: ackSettings{Policy: "count", Count: 100, Prefetch: 50}, wantErr: true},
+		{name: "count with the broker default prefetch", acks: ackSettings{Policy: "count", Count: 100}},
+		{name: "rotation", acks: ackSettings{Policy: "rotation"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkAcks(tt.acks); (err != nil) != tt.wantErr {
+				t.Errorf("checkAcks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/jeks313/activemq-archiver/internal/consumer"
+	"github.com/jeks313/activemq-archiver/internal/stomptest"
+	"github.com/rs/zerolog"
+)
+
+func Test_supervisorShutdown(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	working, complete := filepath.Join(dir, "working"), filepath.Join(dir, "complete")
+	for _, path := range []string{working, complete} {
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var messages []*frame.Frame
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("m-%d", i)
+		m := frame.New(frame.MESSAGE, frame.Destination, "/queue/Consumer.Archive.VirtualTopic.Usage", frame.MessageId, id, frame.Ack, id)
+		m.Body = []byte(fmt.Sprintf(`{"n":"%d"}`, i))
+		messages = append(messages, m)
+	}
+	var mu sync.Mutex
+	unpublished := 0 // acks sent before the archives were published
+	b := stomptest.Start(t, &stomptest.Broker{Messages: messages, Seen: func(f *frame.Frame) {
+		if f.Command != frame.ACK {
+			return
+		}
+		files, _ := filepath.Glob(filepath.Join(complete, "*.log"))
+		if len(files) != len(messages) {
+			mu.Lock()
+			unpublished++
+			mu.Unlock()
+		}
+	}})
+	defer b.Close()
+
+	opts.ActiveMQ.Hostname = b.Addr()
+	opts.ActiveMQ.ReapInterval = time.Second
+	opts.ActiveMQ.AckCount = 100 // not reached, so everything is acked on shutdown
+	opts.ActiveMQ.AckInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	spec := topicSpec{Topic: "Usage", Key: "n", ArchivePath: working, CompletePath: complete, Time: timeSpec{Source: "arrival"}, Sink: sinkSpec{Layout: "flat", Format: "json", Compression: "none", MaxSize: 1 << 20}}
+	s := newSupervisor(ctx, ctx, spec, consumer.AckPolicyCount)
+	s.failover = consumer.Failover{Delay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond, Multiplier: 2}
+	if _, err := s.Apply([]topicSpec{spec}); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	archives := s.sinks[working].archives
+	deadline := time.Now().Add(5 * time.Second)
+	for archives.Written() < uint64(len(messages)) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the messages to be written, got %d", archives.Written())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Shutdown(5 * time.Second)
+	want := []string{frame.CONNECT, frame.SUBSCRIBE, frame.BEGIN, frame.ACK, frame.ACK, frame.ACK, frame.COMMIT, frame.UNSUBSCRIBE, frame.DISCONNECT}
+	var got []string
+	for len(b.Frames) > 0 {
+		got = append(got, (<-b.Frames).Command)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("frames = %v, want %v", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if unpublished > 0 {
+		t.Errorf("%d messages were acked before their archives were published", unpublished)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jeks313/activemq-archiver/internal/archive"
+	"github.com/jeks313/activemq-archiver/internal/consumer"
+	"github.com/jeks313/activemq-archiver/internal/upload"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadStopTimeout is how long applying a config waits for the pipelines it stops, short of the http
+// write timeout so /admin/reload can still respond, ones that take longer are started again once they stop
+const reloadStopTimeout = 10 * time.Second
+
+// supervisor runs a pipeline per topic and the archives they write to
+type supervisor struct {
+	ctx         context.Context // parent of the pipelines, cancelled on shutdown
+	uploadCtx   context.Context // uploaders run until the archives are closed on shutdown
+	defaults    topicSpec       // settings from the command line
+	ackPolicy   string
+	quarantine  *archive.Archives
+	login       string
+	passcode    string
+	tls         *tls.Config
+	failover    consumer.Failover // backoff settings, each pipeline parses the brokers into its own
+	stopTimeout time.Duration     // how long Apply waits for the pipelines it stops
+	applying    sync.Mutex        // held while a config is applied, which waits without holding the lock below
+	sync.Mutex
+	wanted    []topicSpec          // the specs last applied
+	shutdown  bool                 // nothing is started once shutting down
+	pipelines map[string]*pipeline // by topic
+	strays    map[string]*pipeline // stopped pipelines still writing, by topic
+	sinks     map[string]*sink     // by archive path
+	uploaders map[string]*upload.Uploader
+}
+
+// sink is the archives for an archive path, shared by the topics writing there
+type sink struct {
+	spec     topicSpec // the settings of the first topic, the ones they all agree on
+	archives *archive.Archives
+	stop     context.CancelFunc // stops the reaper
+}
+
+// changes is what applying a config did, by topic
+type changes struct {
+	Started   []string `json:"started"`
+	Stopped   []string `json:"stopped"`
+	Updated   []string `json:"updated"`
+	Restarted []string `json:"restarted"`
+	Deferred  []string `json:"deferred"` // started once the pipeline they replace has stopped
+}
+
+func newSupervisor(ctx, uploadCtx context.Context, defaults topicSpec, ackPolicy string) *supervisor {
+	return &supervisor{
+		ctx:         ctx,
+		uploadCtx:   uploadCtx,
+		defaults:    defaults,
+		ackPolicy:   ackPolicy,
+		stopTimeout: reloadStopTimeout,
+		pipelines:   make(map[string]*pipeline),
+		strays:      make(map[string]*pipeline),
+		sinks:       make(map[string]*sink),
+		uploaders:   make(map[string]*upload.Uploader),
+	}
+}
+
+// Reload re-reads the pipelines from the config file, or the command line topics which can't change,
+// and applies the difference
+func (s *supervisor) Reload() (changes, error) {
+	specs, err := loadSpecs(opts.ActiveMQ.Config, opts.ActiveMQ.Topics, s.defaults)
+	if err != nil {
+		return changes{}, err
+	}
+	err = checkAcks(ackSettings{Policy: s.ackPolicy, Count: opts.ActiveMQ.AckCount, Prefetch: opts.ActiveMQ.Prefetch})
+	if err != nil {
+		return changes{}, err
+	}
+	if opts.Upload.Bucket != "" {
+		err = checkUploads(specs, opts.ActiveMQ.PublishOrphans)
+		if err != nil {
+			return changes{}, err
+		}
+	}
+	return s.Apply(specs)
+}
+
+// Apply starts, stops, updates or restarts the pipelines to match the specs
+func (s *supervisor) Apply(specs []topicSpec) (changes, error) {
+	s.applying.Lock()
+	defer s.applying.Unlock()
+	var c changes
+
+	s.Lock()
+	if s.shutdown {
+		s.Unlock()
+		return c, fmt.Errorf("shutting down")
+	}
+	s.wanted = specs
+	wanted := make(map[string]topicSpec)
+	for _, spec := range specs {
+		wanted[spec.Topic] = spec
+	}
+	changed := s.changedSinks()
+	var stopping []*pipeline
+	for topic, p := range s.pipelines {
+		spec, ok := wanted[topic]
+		switch {
+		case !ok:
+			c.Stopped = append(c.Stopped, topic)
+		case spec.ArchivePath != p.spec.ArchivePath || changed[p.spec.ArchivePath] || !sameSource(spec, p.spec):
+			c.Restarted = append(c.Restarted, topic)
+		default:
+			continue
+		}
+		p.cancel()
+		stopping = append(stopping, p)
+		delete(s.pipelines, topic)
+		s.strays[topic] = p
+		go s.restartAfter(p)
+	}
+	s.Unlock()
+
+	// waiting outside the lock keeps the status endpoint responding
+	wait(stopping, s.stopTimeout)
+
+	s.Lock()
+	defer s.Unlock()
+	if s.shutdown {
+		return c, fmt.Errorf("shutting down")
+	}
+	err := s.converge(&c)
+	sort.Strings(c.Started)
+	sort.Strings(c.Stopped)
+	sort.Strings(c.Updated)
+	sort.Strings(c.Restarted)
+	sort.Strings(c.Deferred)
+	log.Info().Strs("started", c.Started).Strs("stopped", c.Stopped).Strs("updated", c.Updated).Strs("restarted", c.Restarted).Strs("deferred", c.Deferred).Err(err).Msg("pipelines applied")
+	return c, err
+}
+
+// restartAfter waits for a stray pipeline to stop, then releases it and starts the topics that were
+// waiting for it
+func (s *supervisor) restartAfter(p *pipeline) {
+	select {
+	case <-p.done:
+	case <-s.ctx.Done():
+		return
+	}
+	s.applying.Lock()
+	defer s.applying.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	if s.shutdown {
+		return
+	}
+	var c changes
+	err := s.converge(&c)
+	if len(c.Started) > 0 || err != nil {
+		log.Info().Str("topic", p.spec.Topic).Strs("started", c.Started).Err(err).Msg("previous pipeline stopped, pipelines applied")
+	}
+}
+
+// converge releases the strays that have stopped, closes the archives no running topic wants any
+// more, unless a stray still writes to them, and updates or starts the wanted topics, deferring the
+// ones still waiting on a stray
+func (s *supervisor) converge(c *changes) error {
+	settled := s.settle()
+	changed := s.changedSinks()
+	paths := firstByPath(s.wanted)
+	busy := make(map[string]bool)
+	for _, p := range s.strays {
+		busy[p.spec.ArchivePath] = true
+	}
+	for path, sk := range s.sinks {
+		if _, ok := paths[path]; (ok && !changed[path]) || busy[path] {
+			continue
+		}
+		s.closeSink(sk)
+		delete(s.sinks, path)
+	}
+	s.release(settled)
+
+	var err error
+	for _, spec := range s.wanted {
+		if p, ok := s.pipelines[spec.Topic]; ok {
+			if !reflect.DeepEqual(p.spec, spec) {
+				p.reconfigure(spec)
+				c.Updated = append(c.Updated, spec.Topic)
+			}
+			continue
+		}
+		if _, ok := s.strays[spec.Topic]; ok || changed[spec.ArchivePath] && busy[spec.ArchivePath] {
+			log.Warn().Str("topic", spec.Topic).Msg("the previous pipeline hasn't stopped yet, starting once it has")
+			c.Deferred = append(c.Deferred, spec.Topic)
+			continue
+		}
+		startErr := s.start(spec)
+		if startErr != nil {
+			log.Error().Err(startErr).Str("topic", spec.Topic).Msg("failed to start pipeline")
+			err = startErr
+			continue
+		}
+		if !contains(c.Restarted, spec.Topic) {
+			c.Started = append(c.Started, spec.Topic)
+		}
+	}
+	return err
+}
+
+// changedSinks are the archive paths whose sink settings differ from the wanted ones, their archives
+// are closed and opened again with the new settings
+func (s *supervisor) changedSinks() map[string]bool {
+	paths := firstByPath(s.wanted)
+	changed := make(map[string]bool)
+	for path, sk := range s.sinks {
+		if spec, ok := paths[path]; ok && !sameSink(spec, sk.spec) {
+			changed[path] = true
+		}
+	}
+	return changed
+}
+
+// firstByPath is the first spec for each archive path, the one whose sink settings the path is opened with
+func firstByPath(specs []topicSpec) map[string]topicSpec {
+	paths := make(map[string]topicSpec)
+	for _, spec := range specs {
+		if _, ok := paths[spec.ArchivePath]; !ok {
+			paths[spec.ArchivePath] = spec
+		}
+	}
+	return paths
+}
+
+// start runs a pipeline for the topic, opening its archive path first if no other topic has
+func (s *supervisor) start(spec topicSpec) error {
+	sk, err := s.sink(spec)
+	if err != nil {
+		return fmt.Errorf("topic %v: %w", spec.Topic, err)
+	}
+	q := consumer.New()
+	q.Hostname = opts.ActiveMQ.Hostname
+	q.Login = s.login
+	q.Passcode = s.passcode
+	q.VHost = opts.ActiveMQ.VHost
+	q.TLS = s.tls
+	q.HeartBeatSend = opts.ActiveMQ.HeartBeatSend
+	q.HeartBeatReceive = opts.ActiveMQ.HeartBeatReceive
+	q.ReadTimeout = opts.ActiveMQ.ReadTimeout
+	q.ConnectTimeout = opts.ActiveMQ.ConnectTimeout
+	q.Workers = opts.ActiveMQ.Workers
+	q.Prefetch = opts.ActiveMQ.Prefetch
+	q.Topic = spec.Topic
+	q.Subscription = spec.Subscription
+	q.Queue = spec.Consumer
+	q.ClientID = spec.clientID()
+	q.SubscriptionName = spec.SubscriptionName
+	q.ContentTypeHeader = "x-content-type"
+	q.AckPolicy = s.ackPolicy
+	q.AckCount = opts.ActiveMQ.AckCount
+	q.AckInterval = opts.ActiveMQ.AckInterval
+	q.AckMode = opts.ActiveMQ.AckMode
+	q.DeadLetter.Destination = opts.ActiveMQ.DeadLetter
+	if s.quarantine != nil {
+		q.DeadLetter.Quarantine = s.quarantine
+	}
+	failover, err := consumer.ParseFailover(opts.ActiveMQ.Hostname, s.failover)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	q.Ctx = ctx
+	p := &pipeline{queue: q, sink: sk.archives, cancel: cancel, done: make(chan struct{})}
+	p.reconfigure(spec)
+	s.pipelines[spec.Topic] = p
+	go p.run(failover)
+	return nil
+}
+
+// sink gets the archives for the topic's archive path, recovering what a previous run left there
+// and starting its reaper and uploader when it is new
+func (s *supervisor) sink(spec topicSpec) (*sink, error) {
+	if sk, ok := s.sinks[spec.ArchivePath]; ok {
+		return sk, nil
+	}
+	if _, err := os.Stat(spec.ArchivePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("archive path %v does not exist", spec.ArchivePath)
+	}
+	if spec.CompletePath != "" {
+		if _, err := os.Stat(spec.CompletePath); os.IsNotExist(err) {
+			return nil, fmt.Errorf("complete path %v does not exist", spec.CompletePath)
+		}
+	}
+	a, err := spec.archives()
+	if err != nil {
+		return nil, err
+	}
+	a.Lateness = opts.ActiveMQ.Lateness
+	a.Skew = opts.ActiveMQ.ClockSkew
+	a.MaxOpen = opts.ActiveMQ.MaxOpen
+	a.MaxBuffered = opts.ActiveMQ.MaxBuffered
+	if opts.Upload.Bucket != "" {
+		uploader, err := s.uploader(spec)
+		if err != nil {
+			return nil, err
+		}
+		a.OnComplete = uploader.Upload
+	}
+	// tidy up after a previous run before writing anything, so appends start on a complete record
+	err = a.Recover(opts.ActiveMQ.PublishOrphans)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover archives from a previous run: %w", err)
+	}
+	ctx, stop := context.WithCancel(s.ctx)
+	go a.Reap(ctx, opts.ActiveMQ.ReapInterval, opts.ActiveMQ.IdleTimeout)
+	sk := &sink{spec: spec, archives: a, stop: stop}
+	s.sinks[spec.ArchivePath] = sk
+	return sk, nil
+}
+
+// uploader gets the uploader for the directory the topic's completed files end up in
+func (s *supervisor) uploader(spec topicSpec) (*upload.Uploader, error) {
+	root := spec.CompletePath
+	if root == "" {
+		root = spec.ArchivePath
+	}
+	if uploader, ok := s.uploaders[root]; ok {
+		return uploader, nil
+	}
+	uploader, err := upload.New(upload.Options{
+		Endpoint:     opts.Upload.Endpoint,
+		Region:       opts.Upload.Region,
+		Bucket:       opts.Upload.Bucket,
+		Prefix:       opts.Upload.Prefix,
+		AccessKey:    opts.Upload.AccessKey,
+		SecretKey:    opts.Upload.SecretKey,
+		PathStyle:    opts.Upload.PathStyle,
+		Root:         root,
+		ScanOnStart:  spec.CompletePath != "",
+		PartSize:     opts.Upload.PartSize,
+		Retries:      opts.Upload.Retries,
+		RetryDelay:   opts.Upload.RetryDelay,
+		DrainTimeout: opts.ShutdownTimeout,
+		AfterUpload:  opts.Upload.AfterUpload,
+		MovePath:     opts.Upload.MovePath,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create uploader: %w", err)
+	}
+	s.uploaders[root] = uploader
+	go uploader.Run(s.uploadCtx) // stopped after the archives are closed so the last files are uploaded
+	return uploader, nil
+}
+
+// wait waits for the cancelled pipelines' consumers to finish the message they are on, giving up on
+// the ones that don't stop in time, which keep their connection
+func wait(pipelines []*pipeline, timeout time.Duration) {
+	deadline := time.After(timeout)
+	expired := false
+	for _, p := range pipelines {
+		if !expired {
+			select {
+			case <-p.done:
+				continue
+			case <-deadline:
+				expired = true
+			}
+		}
+		if !p.stopped() {
+			log.Error().Dur("timeout", timeout).Str("topic", p.spec.Topic).Msg("timed out waiting for the consumer to stop")
+		}
+	}
+}
+
+// settle forgets about the strays that have stopped and returns them
+func (s *supervisor) settle() []*pipeline {
+	var settled []*pipeline
+	for topic, p := range s.strays {
+		if p.stopped() {
+			settled = append(settled, p)
+			delete(s.strays, topic)
+		}
+	}
+	return settled
+}
+
+// release acks what the stopped pipelines wrote, once it is synced or published, and unsubscribes them
+func (s *supervisor) release(pipelines []*pipeline) {
+	for _, p := range pipelines {
+		if !p.stopped() { // the consumer still has the connection, exiting drops it anyway
+			continue
+		}
+		err := p.queue.FlushAndAck(p.sink)
+		if err != nil {
+			log.Error().Err(err).Str("topic", p.spec.Topic).Msg("failed to ack messages written before stopping")
+		}
+		p.queue.Close()
+	}
+}
+
+// closeSink stops the reaper and closes, and so publishes, every open archive
+func (s *supervisor) closeSink(sk *sink) {
+	sk.stop()
+	err := sk.archives.CloseAll()
+	if err != nil {
+		log.Error().Err(err).Str("archive_path", sk.archives.Path).Msg("failed to close all archives")
+	}
+}
+
+// Shutdown stops every pipeline, the consumers finish and ack the message they are on, then the archives
+// are closed (and published) before unsubscribing, so nothing acked is left in a file that isn't complete
+func (s *supervisor) Shutdown(timeout time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.shutdown = true
+	var pipelines []*pipeline
+	for _, p := range s.pipelines {
+		pipelines = append(pipelines, p)
+	}
+	for _, p := range s.strays {
+		pipelines = append(pipelines, p)
+	}
+	for _, p := range pipelines {
+		p.cancel()
+	}
+	wait(pipelines, timeout)
+
+	log.Info().Msg("closing archives ...")
+	for _, sk := range s.sinks {
+		s.closeSink(sk)
+	}
+	if s.quarantine != nil {
+		err := s.quarantine.CloseAll()
+		if err != nil {
+			log.Error().Err(err).Str("archive_path", s.quarantine.Path).Msg("failed to close all archives")
+		}
+	}
+	s.release(pipelines)
+}
+
+// subscription is how a topic is consumed, for the health output
+type subscription struct {
+	Mode             string `json:"mode"`
+	Destination      string `json:"destination"`
+	ClientID         string `json:"clientId,omitempty"`
+	SubscriptionName string `json:"subscriptionName,omitempty"`
+}
+
+// Subscriptions are the running topics and how they are consumed
+func (s *supervisor) Subscriptions() interface{} {
+	s.Lock()
+	defer s.Unlock()
+	subscriptions := make(map[string]subscription)
+	for topic, p := range s.pipelines {
+		sub := subscription{Mode: p.queue.Subscription, Destination: p.queue.Destination()}
+		if sub.Mode == consumer.SubscriptionDurable {
+			sub.ClientID = p.queue.ClientID
+			sub.SubscriptionName = p.queue.SubscriptionName
+		}
+		subscriptions[topic] = sub
+	}
+	return subscriptions
+}
+
+// Uploaders are the uploaders started for the archive paths
+func (s *supervisor) Uploaders() []*upload.Uploader {
+	s.Lock()
+	defer s.Unlock()
+	var uploaders []*upload.Uploader
+	for _, uploader := range s.uploaders {
+		uploaders = append(uploaders, uploader)
+	}
+	return uploaders
+}
+
+// ReloadHandler mounts an endpoint that reloads the config, like a SIGHUP, and responds with the changes
+func (s *supervisor) ReloadHandler(r *mux.Router, route string) {
+	r.HandleFunc(route, func(w http.ResponseWriter, req *http.Request) {
+		log.Info().Str("remote", req.RemoteAddr).Msg("reloading config")
+		c, err := s.Reload()
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "changes": c})
+			return
+		}
+		json.NewEncoder(w).Encode(c)
+	}).Methods(http.MethodPost)
+}
+
+// sameSink is whether two topics write their archive path the same way, the key name in filenames
+// stays the one the archives were opened with when keys change, so the open files aren't closed
+func sameSink(a, b topicSpec) bool {
+	return a.CompletePath == b.CompletePath && a.Sink == b.Sink
+}
+
+// sameSource is whether two topics subscribe to the same destination
+func sameSource(a, b topicSpec) bool {
+	return a.Subscription == b.Subscription && a.Consumer == b.Consumer && a.clientID() == b.clientID() && a.SubscriptionName == b.SubscriptionName
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jeks313/activemq-archiver/internal/consumer"
+	"github.com/rs/zerolog"
+)
+
+func Test_supervisorApply(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled) // the consumers can't connect and log every attempt
+	defer zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	opts.ActiveMQ.Hostname = "127.0.0.1:1"
+	opts.ActiveMQ.ReapInterval = time.Second
+	opts.ActiveMQ.AckInterval = time.Second
+
+	devices, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(devices)
+	web, err := ioutil.TempDir("", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(web)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defaults := topicSpec{Key: "accountUid", Handlers: []string{"zip;json"}, Time: timeSpec{Source: "arrival"}}
+	s := newSupervisor(ctx, ctx, defaults, "write")
+	s.failover = consumer.Failover{Delay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond, Multiplier: 2}
+	defer s.Shutdown(time.Second)
+
+	deviceEvents := defaults
+	deviceEvents.Topic = "DeviceEvents"
+	deviceEvents.ArchivePath = devices
+	webUsage := defaults
+	webUsage.Topic = "WebUsage"
+	webUsage.ArchivePath = web
+
+	c, err := s.Apply([]topicSpec{deviceEvents})
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !reflect.DeepEqual(c.Started, []string{"DeviceEvents"}) {
+		t.Errorf("expected DeviceEvents to be started, got %+v", c)
+	}
+	archives := s.sinks[devices].archives
+
+	deviceEvents.Headers = []string{"esn"}
+	deviceEvents.Key = "deviceUid"
+	c, err = s.Apply([]topicSpec{deviceEvents, webUsage})
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !reflect.DeepEqual(c.Updated, []string{"DeviceEvents"}) || !reflect.DeepEqual(c.Started, []string{"WebUsage"}) {
+		t.Errorf("expected DeviceEvents to be updated and WebUsage started, got %+v", c)
+	}
+	if s.sinks[devices].archives != archives {
+		t.Errorf("expected the archives to stay open when only conversion settings change")
+	}
+	q := s.pipelines["DeviceEvents"].queue
+	q.Reconfigure(func(q *consumer.Queue) {
+		if q.Key != "deviceUid" || !reflect.DeepEqual(q.Headers, []string{"esn"}) {
+			t.Errorf("expected the consumer to have the new settings, got key %v headers %v", q.Key, q.Headers)
+		}
+	})
+
+	webUsage.Sink.Compression = "gzip"
+	c, err = s.Apply([]topicSpec{webUsage})
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !reflect.DeepEqual(c.Stopped, []string{"DeviceEvents"}) || !reflect.DeepEqual(c.Restarted, []string{"WebUsage"}) {
+		t.Errorf("expected DeviceEvents to be stopped and WebUsage restarted, got %+v", c)
+	}
+	if _, ok := s.sinks[devices]; ok {
+		t.Errorf("expected the archives nothing writes to any more to be closed")
+	}
+	if len(s.pipelines) != 1 || len(s.sinks) != 1 {
+		t.Errorf("expected a single pipeline and sink, got %d and %d", len(s.pipelines), len(s.sinks))
+	}
+}
+
+func Test_supervisorApplyStray(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	defer zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	opts.ActiveMQ.Hostname = "127.0.0.1:1"
+	opts.ActiveMQ.ReapInterval = time.Second
+
+	devices, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(devices)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defaults := topicSpec{Key: "accountUid", Handlers: []string{"zip;json"}, Time: timeSpec{Source: "arrival"}}
+	s := newSupervisor(ctx, ctx, defaults, "write")
+	s.failover = consumer.Failover{Delay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond, Multiplier: 2}
+	s.stopTimeout = 50 * time.Millisecond
+	defer s.Shutdown(time.Second)
+
+	// a pipeline whose consumer is stuck and won't stop when cancelled
+	deviceEvents := defaults
+	deviceEvents.Topic = "DeviceEvents"
+	deviceEvents.ArchivePath = devices
+	sk, err := s.sink(deviceEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stuck := &pipeline{spec: deviceEvents, queue: consumer.New(), sink: sk.archives, cancel: func() {}, done: make(chan struct{})}
+	s.pipelines[deviceEvents.Topic] = stuck
+
+	deviceEvents.Sink.Compression = "gzip"
+	c, err := s.Apply([]topicSpec{deviceEvents})
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !reflect.DeepEqual(c.Deferred, []string{"DeviceEvents"}) {
+		t.Errorf("expected DeviceEvents to be deferred while its pipeline hasn't stopped, got %+v", c)
+	}
+	s.Lock()
+	if s.sinks[devices] != sk {
+		t.Errorf("expected the archives a stray pipeline writes to to stay open")
+	}
+	if _, ok := s.pipelines[deviceEvents.Topic]; ok || s.strays[deviceEvents.Topic] != stuck {
+		t.Errorf("expected the topic to be left to the stray pipeline, got pipelines %v strays %v", s.pipelines, s.strays)
+	}
+	s.Unlock()
+
+	// the topic is started without applying again once the stray stops
+	close(stuck.done)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.Lock()
+		_, started := s.pipelines[deviceEvents.Topic]
+		strays, reopened := len(s.strays), s.sinks[devices]
+		s.Unlock()
+		if started {
+			if strays != 0 {
+				t.Errorf("expected the stray to be released, got %d strays", strays)
+			}
+			if reopened == sk || reopened.spec.Sink.Compression != "gzip" {
+				t.Errorf("expected the archives to be reopened with the new settings")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for DeviceEvents to be started once the stray stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
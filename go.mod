@@ -4,10 +4,11 @@ go 1.13
 
 require (
 	github.com/DATA-DOG/go-sqlmock v1.3.3 // indirect
+	github.com/aws/aws-sdk-go v1.35.20
 	github.com/bxcodec/faker v2.0.1+incompatible
 	github.com/cweill/gotests v1.5.3 // indirect
 	github.com/go-errors/errors v1.0.1 // indirect
-	github.com/go-sql-driver/mysql v1.4.1
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/go-stomp/stomp v2.0.5+incompatible
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/handlers v1.4.2
@@ -15,6 +16,7 @@ require (
 	github.com/hootsuite/healthchecks v2.0.1+incompatible
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/joho/godotenv v1.3.0
+	github.com/klauspost/compress v1.11.13
 	github.com/magefile/mage v1.9.0
 	github.com/markbates/pkger v0.12.8
 	github.com/prometheus/client_golang v1.2.1
@@ -22,5 +24,8 @@ require (
 	github.com/tidwall/gjson v1.5.0
 	github.com/tidwall/pretty v1.0.1
 	github.com/tidwall/sjson v1.0.4
+	github.com/xitongsys/parquet-go v1.5.4
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 	google.golang.org/appengine v1.6.5 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
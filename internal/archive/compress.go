@@ -0,0 +1,99 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how archive files are encoded on disk
+type Compression string
+
+// Supported archive compression modes
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// ParseCompression converts a command line value into a Compression mode
+func ParseCompression(s string) (Compression, error) {
+	switch Compression(s) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip:
+		return CompressionGzip, nil
+	case CompressionZstd:
+		return CompressionZstd, nil
+	}
+	return CompressionNone, fmt.Errorf("unknown compression: %v", s)
+}
+
+// extension is the filename suffix added for the compression mode
+func (c Compression) extension() string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// encoder wraps the archive file, Flush pushes buffered data to the file and Close
+// writes any trailing data (e.g. the gzip footer) without closing the file itself
+type encoder interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// newEncoder creates the encoder for a newly opened file, level 0 uses the default level
+// of the compression mode. Each encoder writes one complete gzip member or zstd frame
+// which is finished on Close, reopening a file to append starts a new member or frame
+// rather than continuing a broken one, and readers handle the concatenation transparently.
+func newEncoder(c Compression, level int, w io.Writer) (encoder, error) {
+	switch c {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		zstdLevel := zstd.SpeedDefault
+		if level != 0 {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		// one goroutine per encoder, we can have a lot of archives open at once
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1))
+	}
+	return plainEncoder{w}, nil
+}
+
+// plainEncoder writes straight through to the file
+type plainEncoder struct {
+	io.Writer
+}
+
+func (plainEncoder) Flush() error { return nil }
+func (plainEncoder) Close() error { return nil }
+
+// countingWriter keeps track of the bytes that actually made it to the file
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n = c.n + n
+	return n, err
+}
+
+// worstCaseSize is an upper bound of the on disk size of n bytes once compressed,
+// covering incompressible data stored in raw blocks plus the stream header and footer
+func worstCaseSize(n int) int {
+	return n + (n/16383+1)*5 + 32
+}
@@ -1,6 +1,8 @@
 package archive
 
 import (
+	"container/list"
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -8,58 +10,335 @@ import (
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-// Archives is a set of archive files, one per time period per key
+// Archives is a set of archive files, one per hour per key, the hour comes from the time passed
+// to Write so late events can go to their own hour for as long as the lateness window allows
 type Archives struct {
-	Path string // path to write to
+	Path         string                // path to write to
+	CompletePath string                // when set files are written to Path as .tmp and moved here once complete
+	Layout       Layout                // how archive files are named, defaults to flat
+	Template     *FilenameTemplate     // how archive files are named, overrides Layout when set
+	KeyName      string                // what the documents are partitioned on, available to filename templates
+	Format       Format                // layout of the documents in the archive files, defaults to json
+	Compression  Compression           // how archive files are encoded, defaults to none
+	Level        int                   // compression level, 0 is the default for the compression mode
+	OnComplete   func(filename string) // called with the final filename of every archive once closed
+	Lateness     time.Duration         // how long after the end of its hour an archive is kept open for late events
+	Skew         time.Duration         // how far ahead of the clock event times may be, defaults to DefaultSkew
+	MaxOpen      int                   // most archive files kept open at once, least recently written are suspended past this, 0 is unlimited
+	MaxBuffered  int                   // most bytes parquet archives buffer in memory, least recently written are closed past this, 0 is unlimited
 	sync.Mutex
-	maxBytes int
-	archives map[string]*Archive
+	maxBytes  int
+	archives  map[string]*Archive
+	recent    *list.List            // archives with an open file, most recently written first
+	written   uint64                // sequence number of the last write
+	buffered  int                   // bytes buffered in memory by the parquet archives
+	unsynced  map[*Archive]uint64   // first write to each archive not synced to disk yet
+	parts     map[string]closedPart // next part index for archives closed within the last day
+	lastSweep time.Time             // hour of the last check for archives that are done with
+}
+
+// DefaultSkew is how far ahead of the clock event times may be when Archives.Skew isn't set
+const DefaultSkew = 5 * time.Minute
+
+// closedPart remembers where to carry on from if more events turn up for a closed archive
+type closedPart struct {
+	hour  time.Time
+	index int
 }
 
 // New creates a new Archives et
 func New(maxBytes int) *Archives {
 	a := &Archives{}
 	a.archives = make(map[string]*Archive)
+	a.parts = make(map[string]closedPart)
+	a.recent = list.New()
+	a.unsynced = make(map[*Archive]uint64)
 	a.maxBytes = maxBytes
 	return a
 }
 
-// CheckAndClose goes through the open archives and closes them if they are done with
+// CheckAndClose goes through the open archives and closes them if they are done with,
+// which is once the end of their hour plus the lateness window has passed
 func (a *Archives) CheckAndClose() {
 	a.Lock()
 	defer a.Unlock()
-	for k, arch := range a.archives {
-		if arch.NeedsRotation(0) {
-			err := arch.Close()
-			if err != nil {
-				log.Error().Err(err).Str("key", k).Str("filename", arch.filename).Msg("failed to close archive")
-				continue
+	a.closeExpired(time.Now())
+}
+
+// Reap closes expired archives, and idle ones when idle is set, every interval until the context is done
+func (a *Archives) Reap(ctx context.Context, interval, idle time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	log.Info().Dur("interval", interval).Dur("idle_timeout", idle).Msg("archive: starting reaper")
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("archive: stopping reaper")
+			return
+		case now := <-ticker.C:
+			a.Lock()
+			a.closeExpired(now)
+			if idle > 0 {
+				a.closeIdle(now, idle)
 			}
-			delete(a.archives, k)
+			a.Unlock()
 		}
 	}
 }
 
-// Writes a document with a certain key
-func (a *Archives) Write(topic, key string, doc []byte) error {
-	k := fmt.Sprintf("%s/%s", topic, key)
-	if a, ok := a.archives[k]; ok {
-		return writeErr(a, doc)
+func (a *Archives) closeExpired(now time.Time) {
+	a.lastSweep = now.Truncate(time.Hour)
+	for k, arch := range a.archives {
+		if arch.Expired(now, a.Lateness) {
+			a.close(k, arch, "expired")
+		}
+	}
+	for k, part := range a.parts {
+		if now.Sub(part.hour) > 24*time.Hour+a.Lateness {
+			delete(a.parts, k)
+		}
+	}
+}
+
+func (a *Archives) closeIdle(now time.Time, idle time.Duration) {
+	for k, arch := range a.archives {
+		if now.Sub(arch.LastWrite()) >= idle {
+			a.close(k, arch, "idle")
+		}
 	}
-	arch := &Archive{topic: topic, key: key, maxBytes: a.maxBytes, path: a.Path}
-	err := arch.Open()
+}
+
+// close closes an archive and forgets about it, apart from the part index so very late events
+// start a new part rather than overwrite one that may have been picked up already
+func (a *Archives) close(k string, arch *Archive, reason string) error {
+	buffered := arch.Buffered()
+	err := arch.Close()
 	if err != nil {
-		log.Error().Err(err).Str("filename", arch.filename).Msg("write: failed to open new archive file")
+		log.Error().Err(err).Str("key", k).Str("filename", arch.filename).Str("reason", reason).Msg("failed to close archive")
 		return err
 	}
+	a.buffered = a.buffered - buffered
+	archivesBuffered.Sub(float64(buffered))
+	delete(a.archives, k)
+	delete(a.unsynced, arch)
+	a.parts[k] = closedPart{hour: arch.hour, index: arch.index + 1}
+	if arch.recent != nil {
+		a.recent.Remove(arch.recent)
+		arch.recent = nil
+		archivesOpen.Dec()
+	}
+	archivesClosed.With(prometheus.Labels{"reason": reason}).Inc()
+	return nil
+}
+
+// Close closes every open archive, the same as CloseAll
+func (a *Archives) Close() error {
+	return a.CloseAll()
+}
+
+// CloseAll closes every open archive, returning the last error seen
+func (a *Archives) CloseAll() error {
 	a.Lock()
 	defer a.Unlock()
+	var lastErr error
+	for k, arch := range a.archives {
+		err := a.close(k, arch, "shutdown")
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// CloseUnsynced closes the archives holding documents that are not durable yet, after a Flush only
+// parquet ones, so acks don't have to wait for them to be rotated
+func (a *Archives) CloseUnsynced() error {
+	a.Lock()
+	defer a.Unlock()
+	var lastErr error
+	for k, arch := range a.archives {
+		if _, ok := a.unsynced[arch]; !ok {
+			continue
+		}
+		err := a.close(k, arch, "acks")
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Writes a document with a certain key to the archive for the hour of t, which is the time of
+// the event or zero for the current time, the headers are the ones merged into the document
+func (a *Archives) Write(topic, key string, t time.Time, headers map[string]string, doc []byte) error {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	t = a.eventTime(t, now)
+	hour := t.Truncate(time.Hour)
+	tmpl := a.Template
+	if tmpl == nil {
+		tmpl = a.Layout.template()
+	}
+	// archives are identified by their filename for the hour without the part index
+	k, err := tmpl.render(topic, a.KeyName, key, hour, 0, headers)
+	if err != nil {
+		log.Error().Err(err).Str("template", tmpl.String()).Msg("write: failed to render filename template")
+		return err
+	}
+	if now.Truncate(time.Hour).After(a.lastSweep) { // new hour, close off the archives that are done with
+		a.closeExpired(now)
+	}
+	a.limitBuffered(len(doc) + 1)
+	if arch, ok := a.archives[k]; ok {
+		if arch.Suspended() {
+			a.makeRoom()
+		}
+		a.touch(arch)
+		return a.writeErr(arch, doc)
+	}
+	a.makeRoom()
+	arch := &Archive{topic: topic, key: key, hour: hour, index: a.parts[k].index, keyName: a.KeyName, headers: headers, tmpl: tmpl, maxBytes: a.maxBytes, path: a.Path, completePath: a.CompletePath, format: a.Format, compression: a.Compression, level: a.Level, onComplete: a.OnComplete}
+	err = arch.Open()
+	if err != nil {
+		log.Error().Err(err).Str("filename", arch.filename).Msg("write: failed to open new archive file")
+		return err
+	}
 	a.archives[k] = arch
-	return writeErr(arch, doc)
+	a.touch(arch)
+	return a.writeErr(arch, doc)
+}
+
+// eventTime is the time in UTC to file a document under, the arrival time when it's zero or outside
+// the window of archives that can be open: after the lateness window or further ahead than the skew
+func (a *Archives) eventTime(t, now time.Time) time.Time {
+	if t.IsZero() {
+		return now.UTC()
+	}
+	skew := a.Skew
+	if skew <= 0 {
+		skew = DefaultSkew
+	}
+	switch {
+	case !now.Before(t.Truncate(time.Hour).Add(time.Hour + a.Lateness)):
+		eventTimeFallbacks.With(prometheus.Labels{"reason": "late"}).Inc()
+		log.Debug().Time("event_time", t).Dur("lateness", a.Lateness).Msg("write: event time is past the lateness window, using arrival time")
+		return now.UTC()
+	case t.After(now.Add(skew)):
+		eventTimeFallbacks.With(prometheus.Labels{"reason": "future"}).Inc()
+		log.Debug().Time("event_time", t).Dur("skew", skew).Msg("write: event time is in the future, using arrival time")
+		return now.UTC()
+	}
+	return t.UTC()
+}
+
+// writeErr writes to an archive keeping track of what has not been synced to disk yet, a rotation
+// closes the previous part so only this write is left unsynced
+func (a *Archives) writeErr(arch *Archive, doc []byte) error {
+	index := arch.Index()
+	buffered := arch.Buffered()
+	err := writeErr(arch, doc)
+	buffered = arch.Buffered() - buffered
+	a.buffered = a.buffered + buffered
+	archivesBuffered.Add(float64(buffered))
+	if err != nil {
+		return err
+	}
+	a.written = a.written + 1
+	if _, ok := a.unsynced[arch]; !ok || arch.Index() != index {
+		a.unsynced[arch] = a.written
+	}
+	return nil
+}
+
+// Written is the sequence number of the last document written, starting from 1
+func (a *Archives) Written() uint64 {
+	a.Lock()
+	defer a.Unlock()
+	return a.written
+}
+
+// Durable is the sequence number of the last document written for which it and every document
+// before it have been synced to disk, by Flush or by their archive being rotated, suspended or closed
+func (a *Archives) Durable() uint64 {
+	a.Lock()
+	defer a.Unlock()
+	durable := a.written
+	for _, first := range a.unsynced {
+		if first-1 < durable {
+			durable = first - 1
+		}
+	}
+	return durable
+}
+
+// Flush flushes and syncs every archive written to since it was last synced, parquet archives are
+// left out as their documents are only in memory until the file is rotated or closed
+func (a *Archives) Flush() error {
+	a.Lock()
+	defer a.Unlock()
+	var lastErr error
+	for arch := range a.unsynced {
+		if arch.format == FormatParquet {
+			continue
+		}
+		err := arch.Sync()
+		if err != nil {
+			log.Error().Err(err).Str("key", arch.key).Str("filename", arch.filename).Msg("failed to sync archive")
+			lastErr = err
+			continue
+		}
+		delete(a.unsynced, arch)
+	}
+	return lastErr
+}
+
+// touch marks an archive as the most recently written
+func (a *Archives) touch(arch *Archive) {
+	if arch.recent == nil {
+		arch.recent = a.recent.PushFront(arch)
+		archivesOpen.Inc()
+		return
+	}
+	a.recent.MoveToFront(arch.recent)
+}
+
+// makeRoom suspends the least recently written archives until there is room to open another file
+func (a *Archives) makeRoom() {
+	for a.MaxOpen > 0 && a.recent.Len() >= a.MaxOpen {
+		arch := a.recent.Remove(a.recent.Back()).(*Archive)
+		arch.recent = nil
+		archivesOpen.Dec()
+		err := arch.Suspend()
+		if err != nil {
+			log.Error().Err(err).Str("key", arch.key).Str("filename", arch.filename).Msg("failed to suspend archive")
+		} else if arch.format != FormatParquet {
+			delete(a.unsynced, arch)
+		}
+		archivesEvicted.Inc()
+	}
+}
+
+// limitBuffered closes the least recently written parquet archives until there is room to buffer
+// another size bytes
+func (a *Archives) limitBuffered(size int) {
+	for a.MaxBuffered > 0 && a.buffered+size > a.MaxBuffered {
+		var oldest *Archive
+		var key string
+		for k, arch := range a.archives {
+			if arch.Buffered() > 0 && (oldest == nil || arch.LastWrite().Before(oldest.LastWrite())) {
+				oldest, key = arch, k
+			}
+		}
+		if oldest == nil || a.close(key, oldest, "memory") != nil {
+			return
+		}
+	}
 }
 
 func writeErr(arch *Archive, doc []byte) error {
@@ -76,29 +355,59 @@ func writeErr(arch *Archive, doc []byte) error {
 // Archive is a single file representing a timeslice of data for a particular key
 type Archive struct {
 	sync.Mutex
-	topic          string
-	dateTimeFormat string
-	template       string
-	key            string
-	filename       string
-	out            *os.File
-	path           string
-	logger         zerolog.Logger
-	writes         int64
-	sizeBytes      int
-	maxBytes       int
-	index          int
+	topic        string
+	hour         time.Time // start of the hour this archive is for
+	tmpl         *FilenameTemplate
+	keyName      string
+	headers      map[string]string
+	key          string
+	name         string // archive filename without the directory
+	filename     string // file being written to
+	file         *os.File
+	counter      *countingWriter // bytes on disk
+	out          encoder
+	format       Format
+	compression  Compression
+	level        int
+	path         string
+	completePath string
+	onComplete   func(filename string)
+	logger       zerolog.Logger
+	writes       int64
+	sizeBytes    int
+	lastWrite    time.Time
+	recent       *list.Element // position in Archives.recent while the file is open
+	pending      int           // bytes written to the encoder since the last flush, or buffered for parquet
+	maxBytes     int
+	index        int
 }
 
 // Open opens an archive file based on the current time and key
 func (a *Archive) Open() error {
 	a.Lock()
 	defer a.Unlock()
-	a.filename = a.formatFilename()
-	a.logger = log.With().Str("filename", a.filename).Str("key", a.key).Logger()
+	if a.compression == "" {
+		a.compression = CompressionNone
+	}
+	if a.format == "" {
+		a.format = FormatJSON
+	}
+	a.name = a.formatFilename(a.index)
+	for a.partTaken() {
+		a.index = a.index + 1
+		a.name = a.formatFilename(a.index)
+	}
+	a.filename = a.workingFilename(a.name)
+	err := os.MkdirAll(path.Dir(a.filename), 0755)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to create archive directory")
+		return err
+	}
+	a.logger = log.With().Str("filename", a.filename).Str("key", a.key).Time("hour", a.hour).Logger()
 	a.logger.Info().Msg("opening new archive")
 	a.writes = 0
 	a.sizeBytes = 0
+	a.pending = 0
 	openFlag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
 	f, err := os.OpenFile(a.filename, openFlag, 0644)
 	if os.IsExist(err) {
@@ -108,7 +417,25 @@ func (a *Archive) Open() error {
 		log.Error().Err(err).Msg("unable to create or append file")
 		return err
 	}
-	a.out = f
+	a.file = f
+	a.counter = &countingWriter{w: f}
+	if info, err := f.Stat(); err == nil && info.Size() > 0 { // left by a previous run, carry on from its size
+		a.logger.Info().Int64("size", info.Size()).Msg("appending to existing archive")
+		a.counter.n = int(info.Size())
+		if a.compression == CompressionNone {
+			a.sizeBytes = a.counter.n
+		}
+	}
+	if a.format == FormatParquet {
+		a.out = newParquetEncoder(a.compression, a.counter)
+	} else {
+		a.out, err = newEncoder(a.compression, a.level, a.counter)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("unable to create compression encoder")
+		f.Close()
+		return err
+	}
 	a.logger.Debug().Msg("opened new file")
 	return nil
 }
@@ -118,21 +445,217 @@ func (a *Archive) Close() error {
 	a.Lock()
 	defer a.Unlock()
 	a.logger.Info().Int64("writes", a.writes).Msg("closing")
-	err := a.out.Sync()
+	if a.file == nil && a.format != FormatParquet { // suspended, the file was already finished and synced
+		a.writes = 0
+		a.sizeBytes = 0
+		a.pending = 0
+		return a.publish()
+	}
+	err := a.resume()
+	if err != nil {
+		return err
+	}
+	err = a.out.Close()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to finish compressed stream on close")
+		return err
+	}
+	err = a.file.Sync()
 	if err != nil {
 		log.Error().Err(err).Msg("failed to sync file on close")
 		return err
 	}
 	a.writes = 0
 	a.sizeBytes = 0
-	return a.out.Close()
+	a.pending = 0
+	err = a.file.Close()
+	a.file = nil
+	if err != nil {
+		log.Error().Err(err).Msg("failed to close file")
+		return err
+	}
+	return a.publish()
+}
+
+// Suspend syncs and closes the file until it is next written to, parquet documents stay buffered
+func (a *Archive) Suspend() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	if a.format != FormatParquet { // parquet buffers everything until close, so nothing to finish
+		err := a.out.Close()
+		if err != nil {
+			a.logger.Error().Err(err).Msg("failed to finish compressed stream on suspend")
+			return err
+		}
+		a.pending = 0
+	}
+	err := a.file.Sync()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("failed to sync file on suspend")
+		return err
+	}
+	err = a.file.Close()
+	a.file = nil
+	if err != nil {
+		a.logger.Error().Err(err).Msg("failed to close file on suspend")
+		return err
+	}
+	a.logger.Debug().Msg("suspended")
+	return nil
+}
+
+// Sync flushes any compressed data and syncs the file to disk, parquet documents are buffered in
+// memory so they can't be synced until the file is closed
+func (a *Archive) Sync() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.file == nil || a.format == FormatParquet {
+		return nil
+	}
+	err := a.out.Flush()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("failed to flush compressed stream on sync")
+		return err
+	}
+	a.pending = 0
+	err = a.file.Sync()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("failed to sync file")
+		return err
+	}
+	return nil
+}
+
+// Buffered is the bytes of documents held in memory until the archive is closed, only parquet buffers
+func (a *Archive) Buffered() int {
+	a.Lock()
+	defer a.Unlock()
+	if a.format != FormatParquet {
+		return 0
+	}
+	return a.pending
+}
+
+// Index is the part index currently being written
+func (a *Archive) Index() int {
+	a.Lock()
+	defer a.Unlock()
+	return a.index
+}
+
+// Suspended checks if the file has been closed by Suspend
+func (a *Archive) Suspended() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.file == nil
+}
+
+// resume reopens a suspended archive in append mode, the lock must be held
+func (a *Archive) resume() error {
+	if a.file != nil {
+		return nil
+	}
+	f, err := os.OpenFile(a.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("unable to reopen suspended archive")
+		return err
+	}
+	a.counter.w = f
+	if a.format != FormatParquet {
+		a.out, err = newEncoder(a.compression, a.level, a.counter)
+		if err != nil {
+			a.logger.Error().Err(err).Msg("unable to create compression encoder")
+			f.Close()
+			return err
+		}
+	}
+	a.file = f
+	archivesReopened.Inc()
+	a.logger.Debug().Msg("reopened suspended archive")
+	return nil
 }
 
-const template = "topic=<TOPIC>_dt=<DATETIME>_accountUID=<KEY>_part=<INDEX>.log"
-const dateTimeFormat = "2006-01-02T15:00Z"
+// publish moves a closed archive into the complete path, a rename so watchers of the
+// complete path never see a partial file, which needs both paths on the same filesystem
+func (a *Archive) publish() error {
+	completed := a.filename
+	if a.completePath != "" {
+		completed = path.Join(a.completePath, a.name)
+		err := os.MkdirAll(path.Dir(completed), 0755)
+		if err == nil {
+			err = os.Rename(a.filename, completed)
+		}
+		if err != nil {
+			a.logger.Error().Err(err).Str("complete_filename", completed).Msg("failed to publish archive")
+			return err
+		}
+		a.logger.Info().Str("complete_filename", completed).Msg("published archive")
+		removeEmptyDirs(path.Dir(a.filename), a.path)
+	}
+	if a.onComplete != nil {
+		a.onComplete(completed)
+	}
+	return nil
+}
+
+// partTaken checks if the current part was already published or rotated past, or is a parquet file
+func (a *Archive) partTaken() bool {
+	if a.completePath != "" && fileExists(path.Join(a.completePath, a.name)) {
+		return true
+	}
+	if a.format == FormatParquet && fileExists(a.workingFilename(a.name)) {
+		return true
+	}
+	next := a.formatFilename(a.index + 1)
+	return fileExists(a.workingFilename(next)) || (a.completePath != "" && fileExists(path.Join(a.completePath, next)))
+}
+
+// workingFilename is where an archive is written to until it is published
+func (a *Archive) workingFilename(name string) string {
+	if a.completePath != "" {
+		return path.Join(a.path, name) + ".tmp"
+	}
+	return path.Join(a.path, name)
+}
+
+// Layout selects how archive files are named and laid out under the archive path
+type Layout string
+
+// Supported archive layouts
+const (
+	LayoutFlat Layout = "flat" // everything in the filename: topic=X_dt=2006-01-02T15:00Z_accountUID=Y_part=00.log
+	LayoutHive Layout = "hive" // hive style partition directories: topic=X/dt=2006-01-02/hour=15/accountUID=Y/part-00.log
+)
+
+// ParseLayout converts a command line value into a Layout
+func ParseLayout(s string) (Layout, error) {
+	switch Layout(s) {
+	case "", LayoutFlat:
+		return LayoutFlat, nil
+	case LayoutHive:
+		return LayoutHive, nil
+	}
+	return LayoutFlat, fmt.Errorf("unknown layout: %v", s)
+}
+
+func (l Layout) template() *FilenameTemplate {
+	if t, ok := layoutTemplates[l]; ok {
+		return t
+	}
+	return layoutTemplates[LayoutFlat]
+}
 
 // Write writes a provided document to the archive, checks if filename needs rotation
 func (a *Archive) Write(doc []byte) (int, error) {
+	a.Lock()
+	err := a.resume()
+	a.Unlock()
+	if err != nil {
+		return 0, err
+	}
 	if a.NeedsRotation(len(doc) + 1) {
 		err := a.Close()
 		if err != nil {
@@ -153,33 +676,61 @@ func (a *Archive) Write(doc []byte) (int, error) {
 	defer a.Unlock()
 	n, err := a.out.Write(doc)
 	a.sizeBytes = a.sizeBytes + n
+	a.lastWrite = time.Now()
+	if a.format == FormatParquet || a.compression != CompressionNone {
+		a.pending = a.pending + n
+	}
 	return n, err
 }
 
-func (a *Archive) formatFilename() string {
-	if a.template == "" {
-		a.template = template
+func (a *Archive) formatFilename(index int) string {
+	if a.tmpl == nil {
+		a.tmpl = layoutTemplates[LayoutFlat]
+	}
+	if a.hour.IsZero() {
+		a.hour = time.Now().UTC().Truncate(time.Hour)
 	}
-	if a.dateTimeFormat == "" {
-		a.dateTimeFormat = dateTimeFormat
+	filename, err := a.tmpl.render(a.topic, a.keyName, a.key, a.hour, index, a.headers)
+	if err != nil {
+		log.Error().Err(err).Str("template", a.tmpl.String()).Msg("failed to render filename template, using the flat layout")
+		filename, _ = layoutTemplates[LayoutFlat].render(a.topic, a.keyName, a.key, a.hour, index, a.headers)
 	}
-	// TODO: this is terrible, should make this a better formatting than string replacements
-	datetime := time.Now().Format(a.dateTimeFormat)
-	filename := strings.Replace(a.template, "<DATETIME>", datetime, -1)
-	filename = strings.Replace(filename, "<TOPIC>", a.topic, -1)
-	filename = strings.Replace(filename, "<KEY>", a.key, -1)
-	filename = strings.Replace(filename, "<INDEX>", fmt.Sprintf("%02d", a.index), -1)
-	return path.Join(a.path, filename)
+	return filename + a.extension()
+}
+
+func (a *Archive) extension() string {
+	if a.format == FormatParquet { // compression is internal to the parquet file
+		return ".parquet"
+	}
+	return ".log" + a.compression.extension()
+}
+
+// LastWrite is when a document was last written to the archive
+func (a *Archive) LastWrite() time.Time {
+	a.Lock()
+	defer a.Unlock()
+	return a.lastWrite
 }
 
-// NeedsRotation checks the filename to see if we need to roll this file over
+// Expired checks if the hour of the archive plus the lateness window has passed
+func (a *Archive) Expired(now time.Time, lateness time.Duration) bool {
+	return !now.Before(a.hour.Add(time.Hour + lateness))
+}
+
+// NeedsRotation checks the size of the file to see if we need to roll this file over, an archive
+// is for a fixed hour so time based rotation is done by Archives closing expired archives
 func (a *Archive) NeedsRotation(currentWriteSize int) bool {
 	a.Lock()
 	defer a.Unlock()
-	filename := a.formatFilename() // picks up time rotation
-	if filename != a.filename {
-		a.index = 0
-		return true
+	if a.format == FormatParquet { // nothing hits the disk until close, the JSON size is an upper bound
+		if a.pending+currentWriteSize+parquetOverhead > a.maxBytes {
+			a.index = a.index + 1
+			return true
+		}
+		return false
+	}
+	if a.compression != CompressionNone {
+		return a.needsCompressedRotation(currentWriteSize)
 	}
 	if a.sizeBytes+currentWriteSize > a.maxBytes { // size rotation so increment index
 		a.index = a.index + 1
@@ -187,3 +738,40 @@ func (a *Archive) NeedsRotation(currentWriteSize int) bool {
 	}
 	return false
 }
+
+// needsCompressedRotation checks the compressed bytes on disk, the encoder buffers data so if
+// the uncompressed pending bytes would take us over the limit we flush to find out the real size
+func (a *Archive) needsCompressedRotation(currentWriteSize int) bool {
+	if a.counter.n+worstCaseSize(a.pending+currentWriteSize) <= a.maxBytes {
+		return false
+	}
+	if a.pending > 0 {
+		err := a.out.Flush()
+		if err != nil {
+			a.logger.Error().Err(err).Msg("failed to flush compressed stream, rotating")
+		} else {
+			a.pending = 0
+			if a.counter.n+worstCaseSize(currentWriteSize) <= a.maxBytes {
+				return false
+			}
+		}
+	}
+	a.index = a.index + 1
+	return true
+}
+
+// removeEmptyDirs removes dir and its parents up to root for as long as they are empty
+func removeEmptyDirs(dir, root string) {
+	root = path.Clean(root)
+	for strings.HasPrefix(dir, root+"/") {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+func fileExists(filename string) bool {
+	info, err := os.Stat(filename)
+	return err == nil && info.Size() > 0
+}
@@ -0,0 +1,571 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func Test_ArchivesWriteCompression(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression Compression
+		maxBytes    int
+		docs        int
+		ext         string
+	}{
+		{
+			name:        "plain single file",
+			compression: CompressionNone,
+			maxBytes:    1 << 20,
+			docs:        100,
+			ext:         ".log",
+		},
+		{
+			name:        "gzip single file",
+			compression: CompressionGzip,
+			maxBytes:    1 << 20,
+			docs:        100,
+			ext:         ".log.gz",
+		},
+		{
+			name:        "zstd single file",
+			compression: CompressionZstd,
+			maxBytes:    1 << 20,
+			docs:        100,
+			ext:         ".log.zst",
+		},
+		{
+			name:        "zstd rotated on compressed size",
+			compression: CompressionZstd,
+			maxBytes:    4096,
+			docs:        2000,
+			ext:         ".log.zst",
+		},
+		{
+			name:        "gzip rotated on compressed size",
+			compression: CompressionGzip,
+			maxBytes:    4096,
+			docs:        2000,
+			ext:         ".log.gz",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "archive")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			a := New(tt.maxBytes)
+			a.Path = dir
+			a.Compression = tt.compression
+			var want []string
+			for i := 0; i < tt.docs; i++ {
+				doc := fmt.Sprintf(`{"id":%d,"accountUid":"abc","value":"%x"}`, i, rand.Int63())
+				want = append(want, doc)
+				if err := a.Write("test", "abc", time.Time{}, nil, []byte(doc)); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			a.CloseAll()
+			files, err := filepath.Glob(filepath.Join(dir, "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(files)
+			var got []string
+			for _, f := range files {
+				if !strings.HasSuffix(f, tt.ext) {
+					t.Errorf("filename %v, want suffix %v", f, tt.ext)
+				}
+				info, err := os.Stat(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Size() > int64(tt.maxBytes) {
+					t.Errorf("file %v size %d exceeds max %d", f, info.Size(), tt.maxBytes)
+				}
+				got = append(got, readLines(t, f, tt.compression)...)
+			}
+			if tt.maxBytes < 1<<20 && len(files) < 2 {
+				t.Errorf("expected rotation, got %d files", len(files))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("read back %d documents, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func readLines(t *testing.T, filename string, c Compression) []string {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch c {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	case CompressionZstd:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	var lines []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("reading %v: %v", filename, err)
+	}
+	return lines
+}
+
+func Test_ArchivesWriteParquet(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression Compression
+		docs        []string
+		wantRows    int64
+		wantColumns int64
+	}{
+		{
+			name:        "headers merged into payload",
+			compression: CompressionNone,
+			docs: []string{
+				`{"id":1,"value":1.5,"headers":{"accountuid":"abc","x-content-type":"zip;json"}}`,
+				`{"id":2,"value":2,"headers":{"accountuid":"abc","x-content-type":"zip;json"}}`,
+			},
+			wantRows:    2,
+			wantColumns: 4,
+		},
+		{
+			name:        "schema is the union of documents, conflicting types as strings",
+			compression: CompressionZstd,
+			docs: []string{
+				`{"id":1,"list":[1,2],"mixed":"a"}`,
+				`{"id":2,"mixed":3,"extra":true}`,
+				`not json`,
+			},
+			wantRows:    2,
+			wantColumns: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "archive")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			a := New(1 << 20)
+			a.Path = dir
+			a.Format = FormatParquet
+			a.Compression = tt.compression
+			for _, doc := range tt.docs {
+				if err := a.Write("test", "abc", time.Time{}, nil, []byte(doc)); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			if err := a.CloseAll(); err != nil {
+				t.Fatalf("CloseAll() error = %v", err)
+			}
+			files, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+			if err != nil || len(files) != 1 {
+				t.Fatalf("expected a single parquet file, got %v (%v)", files, err)
+			}
+			fr, err := local.NewLocalFileReader(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fr.Close()
+			pr, err := reader.NewParquetReader(fr, nil, 1)
+			if err != nil {
+				t.Fatalf("NewParquetReader() error = %v", err)
+			}
+			if got := pr.GetNumRows(); got != tt.wantRows {
+				t.Errorf("rows = %d, want %d", got, tt.wantRows)
+			}
+			if got := int64(len(pr.Footer.RowGroups[0].Columns)); got != tt.wantColumns {
+				t.Errorf("columns = %d, want %d", got, tt.wantColumns)
+			}
+		})
+	}
+}
+
+func Test_ArchivesCompletePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	working := filepath.Join(dir, "working")
+	complete := filepath.Join(dir, "complete")
+	for _, d := range []string{working, complete} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := New(1 << 20)
+	a.Path = working
+	a.CompletePath = complete
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := a.Write("test", "abc", time.Time{}, nil, []byte(fmt.Sprintf(`{"id":%d}`, i))); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+		}
+	}
+	write(10)
+	tmp, _ := filepath.Glob(filepath.Join(working, "*.tmp"))
+	if len(tmp) != 1 {
+		t.Errorf("expected one .tmp file while writing, got %v", tmp)
+	}
+	published, _ := filepath.Glob(filepath.Join(complete, "*"))
+	if len(published) != 0 {
+		t.Errorf("expected nothing published while writing, got %v", published)
+	}
+	a.CloseAll()
+	write(5) // same hour and key again, must not overwrite the published part
+	a.CloseAll()
+	tmp, _ = filepath.Glob(filepath.Join(working, "*"))
+	if len(tmp) != 0 {
+		t.Errorf("expected working path to be empty, got %v", tmp)
+	}
+	published, _ = filepath.Glob(filepath.Join(complete, "*"))
+	sort.Strings(published)
+	if len(published) != 2 {
+		t.Fatalf("expected two published parts, got %v", published)
+	}
+	for i, want := range []int{10, 5} {
+		if !strings.HasSuffix(published[i], fmt.Sprintf("_part=%02d.log", i)) {
+			t.Errorf("published %v, want part %02d", published[i], i)
+		}
+		if got := len(readLines(t, published[i], CompressionNone)); got != want {
+			t.Errorf("%v has %d documents, want %d", published[i], got, want)
+		}
+	}
+}
+
+func Test_ArchivesHiveLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	working := filepath.Join(dir, "working")
+	complete := filepath.Join(dir, "complete")
+	a := New(1 << 20)
+	a.Path = working
+	a.CompletePath = complete
+	a.Layout = LayoutHive
+	now := time.Now()
+	for _, key := range []string{"abc", "def"} {
+		if err := a.Write("test", key, time.Time{}, nil, []byte(`{"id":1}`)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	a.CloseAll()
+	for _, key := range []string{"abc", "def"} {
+		want := filepath.Join(complete, "topic=test", "dt="+now.Format("2006-01-02"), "hour="+now.Format("15"), "accountUID="+key, "part-00.log")
+		if _, err := os.Stat(want); err != nil {
+			t.Errorf("expected archive %v: %v", want, err)
+		}
+	}
+	left, _ := filepath.Glob(filepath.Join(working, "*"))
+	if len(left) != 0 {
+		t.Errorf("expected empty partition directories to be removed, got %v", left)
+	}
+}
+
+func Test_ArchivesEventTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := New(1 << 20)
+	a.Path = dir
+	a.Layout = LayoutHive
+	a.Lateness = 2 * time.Hour
+	now := time.Now().UTC()
+	late := now.Add(-time.Hour)
+	expired := now.Add(-4 * time.Hour)
+	future := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	otherZone := now.In(time.FixedZone("UTC+2", 2*60*60)) // the same hour in UTC
+	for _, ts := range []time.Time{now, late, now, late, expired, future, otherZone} {
+		if err := a.Write("test", "abc", ts, nil, []byte(`{"id":1}`)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if len(a.archives) != 2 {
+		t.Errorf("expected an archive open for the current and late hour, got %d", len(a.archives))
+	}
+	a.CloseAll()
+	for ts, want := range map[time.Time]int{now: 5, late: 2} {
+		filename := filepath.Join(dir, "topic=test", "dt="+ts.Format("2006-01-02"), "hour="+ts.Format("15"), "accountUID=abc", "part-00.log")
+		if got := len(readLines(t, filename, CompressionNone)); got != want {
+			t.Errorf("%v has %d documents, want %d", filename, got, want)
+		}
+	}
+	for _, ts := range []time.Time{expired, future} {
+		if _, err := os.Stat(filepath.Join(dir, "topic=test", "dt="+ts.Format("2006-01-02"), "hour="+ts.Format("15"))); !os.IsNotExist(err) {
+			t.Errorf("expected no archive for %v outside the lateness window and skew", ts)
+		}
+	}
+}
+
+func Test_ArchivesReap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := New(1 << 20)
+	a.Path = dir
+	a.Layout = LayoutHive
+	a.Lateness = time.Hour // the hour written to stays open if the test crosses into the next one
+	hour := time.Now().UTC().Truncate(time.Hour)
+	for _, key := range []string{"idle", "busy"} {
+		if err := a.Write("test", key, hour, nil, []byte(`{"id":1}`)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Reap(ctx, 10*time.Millisecond, 200*time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(150 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if err := a.Write("test", "busy", hour, nil, []byte(`{"id":2}`)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := a.Write("test", "busy", hour, nil, []byte(`{"id":3}`)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	cancel()
+	<-done
+	a.Lock()
+	_, idleOpen := a.archives[archiveKey(t, a, "idle", hour)]
+	_, busyOpen := a.archives[archiveKey(t, a, "busy", hour)]
+	a.Unlock()
+	if idleOpen {
+		t.Errorf("expected the idle archive to be closed")
+	}
+	if !busyOpen {
+		t.Errorf("expected the busy archive to stay open")
+	}
+	if err := a.CloseAll(); err != nil {
+		t.Fatalf("CloseAll() error = %v", err)
+	}
+}
+
+// archiveKey is the map key Write uses for an archive of the hour
+func archiveKey(t *testing.T, a *Archives, key string, hour time.Time) string {
+	k, err := a.Layout.template().render("test", a.KeyName, key, hour, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func Test_ArchivesMaxOpen(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(string(c), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "archive")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			a := New(1 << 20)
+			a.Path = filepath.Join(dir, "working")
+			a.CompletePath = filepath.Join(dir, "complete")
+			a.Layout = LayoutHive
+			a.Compression = c
+			a.MaxOpen = 2
+			a.Lateness = time.Hour
+			hour := time.Now().UTC().Truncate(time.Hour)
+			keys := []string{"a", "b", "c"}
+			for i := 0; i < 10; i++ {
+				for _, key := range keys {
+					if err := a.Write("test", key, hour, nil, []byte(fmt.Sprintf(`{"id":%d}`, i))); err != nil {
+						t.Fatalf("Write() error = %v", err)
+					}
+				}
+				if a.recent.Len() > a.MaxOpen {
+					t.Fatalf("%d archives open, limit is %d", a.recent.Len(), a.MaxOpen)
+				}
+			}
+			if len(a.archives) != len(keys) {
+				t.Errorf("expected evicted archives to be kept, got %d", len(a.archives))
+			}
+			if err := a.CloseAll(); err != nil {
+				t.Fatalf("CloseAll() error = %v", err)
+			}
+			for _, key := range keys {
+				filename := filepath.Join(a.CompletePath, "topic=test", "dt="+hour.Format("2006-01-02"), "hour="+hour.Format("15"), "accountUID="+key, "part-00.log"+c.extension())
+				if got := len(readLines(t, filename, c)); got != 10 {
+					t.Errorf("%v has %d documents, want 10", filename, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_ArchivesOpenGauge(t *testing.T) {
+	before := testutil.ToFloat64(archivesOpen)
+	var sets []*Archives
+	for i := 0; i < 2; i++ { // an archive path each, sharing the gauge
+		dir, err := ioutil.TempDir("", "archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		a := New(1 << 20)
+		a.Path = dir
+		if err := a.Write("test", "abc", time.Time{}, nil, []byte(`{"id":1}`)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		sets = append(sets, a)
+	}
+	if got := testutil.ToFloat64(archivesOpen) - before; got != 2 {
+		t.Errorf("expected both archive paths to be counted, got %v", got)
+	}
+	if err := sets[0].CloseAll(); err != nil {
+		t.Fatalf("CloseAll() error = %v", err)
+	}
+	if got := testutil.ToFloat64(archivesOpen) - before; got != 1 {
+		t.Errorf("expected closing one archive path to leave the other counted, got %v", got)
+	}
+	if err := sets[1].CloseAll(); err != nil {
+		t.Fatalf("CloseAll() error = %v", err)
+	}
+}
+
+func Test_ArchivesMaxBuffered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := New(1 << 20)
+	a.Path = dir
+	a.Format = FormatParquet
+	a.MaxBuffered = 100
+	keys := []string{"a", "b", "c"}
+	for i := 0; i < 10; i++ {
+		for _, key := range keys {
+			if err := a.Write("test", key, time.Time{}, nil, []byte(fmt.Sprintf(`{"id":%d}`, i))); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if a.buffered > a.MaxBuffered {
+				t.Fatalf("%d bytes buffered, limit is %d", a.buffered, a.MaxBuffered)
+			}
+		}
+	}
+	if err := a.CloseAll(); err != nil {
+		t.Fatalf("CloseAll() error = %v", err)
+	}
+	if a.buffered != 0 {
+		t.Errorf("expected nothing buffered once closed, got %d bytes", a.buffered)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	if err != nil || len(files) <= len(keys) {
+		t.Fatalf("expected archives closed early to free memory, got %v (%v)", files, err)
+	}
+	var rows int64
+	for _, filename := range files {
+		fr, err := local.NewLocalFileReader(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr, err := reader.NewParquetReader(fr, nil, 1)
+		if err != nil {
+			t.Fatalf("NewParquetReader() error = %v", err)
+		}
+		rows = rows + pr.GetNumRows()
+		fr.Close()
+	}
+	if rows != 30 {
+		t.Errorf("rows = %d, want 30", rows)
+	}
+}
+
+func Test_ArchivesDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := New(100)
+	a.Path = dir
+	a.Compression = CompressionGzip
+	a.Lateness = time.Hour
+	hour := time.Now().UTC().Truncate(time.Hour)
+	write := func(key string) {
+		if err := a.Write("test", key, hour, nil, []byte(`{"id":1}`)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	check := func(step string, written, durable uint64) {
+		if got := a.Written(); got != written {
+			t.Errorf("%s: Written() = %d, want %d", step, got, written)
+		}
+		if got := a.Durable(); got != durable {
+			t.Errorf("%s: Durable() = %d, want %d", step, got, durable)
+		}
+	}
+	write("a")
+	write("b")
+	check("written", 2, 0)
+	if err := a.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	check("synced", 2, 2)
+	write("b")
+	for i := 0; i < 20; i++ { // rotates a, which syncs everything written to it before
+		write("a")
+	}
+	check("rotated", 23, 2)
+	a.Lock()
+	first := a.unsynced[a.archives[archiveKey(t, a, "a", hour)]]
+	a.Unlock()
+	if first <= 4 {
+		t.Errorf("expected the rotated archive to only have the latest part unsynced, first unsynced write is %d", first)
+	}
+	if err := a.CloseAll(); err != nil {
+		t.Fatalf("CloseAll() error = %v", err)
+	}
+	check("closed", 23, 23)
+}
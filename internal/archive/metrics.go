@@ -0,0 +1,74 @@
+package archive
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	archivesOpen = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "archives_open",
+			Help:      "Number of archive files currently open, not counting evicted archives",
+		},
+	)
+	archivesBuffered = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "archives_buffered_bytes",
+			Help:      "Bytes of documents parquet archives hold in memory until they are closed",
+		},
+	)
+	archivesClosed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "archives_closed_count",
+			Help:      "Number of archive files closed",
+		},
+		[]string{
+			"reason", // expired, idle, memory, acks or shutdown
+		},
+	)
+	eventTimeFallbacks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "event_time_fallbacks_count",
+			Help:      "Number of documents filed under their arrival time as their event time was too late or in the future",
+		},
+		[]string{
+			"reason", // late or future
+		},
+	)
+	archivesEvicted = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "archives_evicted_count",
+			Help:      "Number of archive files closed to stay under the open file limit",
+		},
+	)
+	archivesRecovered = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "archives_recovered_count",
+			Help:      "Number of archive files left by a previous run fixed up on start",
+		},
+		[]string{
+			"action", // truncated, corrupt or orphan
+		},
+	)
+	archivesReopened = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "archives_reopened_count",
+			Help:      "Number of evicted archive files reopened for writing",
+		},
+	)
+)
@@ -0,0 +1,259 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Format selects how documents are laid out inside archive files
+type Format string
+
+// Supported archive formats
+const (
+	FormatJSON    Format = "json"    // newline delimited JSON, one document per line
+	FormatParquet Format = "parquet" // columnar, the schema is inferred from the documents in each file
+)
+
+// ParseFormat converts a command line value into a Format
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case "", FormatJSON:
+		return FormatJSON, nil
+	case FormatParquet:
+		return FormatParquet, nil
+	}
+	return FormatJSON, fmt.Errorf("unknown format: %v", s)
+}
+
+// parquetOverhead is an allowance for the magic bytes, page headers and footer metadata
+// on top of the buffered document size when estimating the size of a parquet file
+const parquetOverhead = 64 * 1024
+
+// parquetEncoder buffers the documents for a whole archive file in memory, Athena and
+// friends need the footer to be able to read anything, so the file is only written out
+// on Close once the schema of every buffered document is known
+type parquetEncoder struct {
+	w           io.Writer
+	compression Compression
+	docs        [][]byte
+}
+
+func newParquetEncoder(c Compression, w io.Writer) *parquetEncoder {
+	return &parquetEncoder{w: w, compression: c}
+}
+
+func (p *parquetEncoder) Write(doc []byte) (int, error) {
+	p.docs = append(p.docs, append([]byte(nil), bytes.TrimSpace(doc)...))
+	return len(doc), nil
+}
+
+// Flush is a no-op, a parquet file is not readable until it is complete
+func (p *parquetEncoder) Flush() error {
+	return nil
+}
+
+// Close infers the schema, writes the row group and footer
+func (p *parquetEncoder) Close() error {
+	if len(p.docs) == 0 {
+		return nil
+	}
+	root := &parquetField{kind: kindObject}
+	values := make([]interface{}, 0, len(p.docs))
+	for _, doc := range p.docs {
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(doc))
+		d.UseNumber()
+		err := d.Decode(&v)
+		if err != nil {
+			log.Error().Err(err).Msg("parquet: skipping document that is not valid JSON")
+			continue
+		}
+		if _, ok := v.(map[string]interface{}); !ok {
+			log.Error().Msg("parquet: skipping document that is not a JSON object")
+			continue
+		}
+		root.merge(v)
+		values = append(values, v)
+	}
+	p.docs = nil
+	schema, err := json.Marshal(root.schema("parquet_go_root", "REQUIRED"))
+	if err != nil {
+		return err
+	}
+	pw, err := writer.NewJSONWriterFromWriter(string(schema), p.w, 1)
+	if err != nil {
+		return err
+	}
+	pw.CompressionType = parquetCodec(p.compression)
+	for _, v := range values {
+		row, err := json.Marshal(root.conform(v))
+		if err != nil {
+			return err
+		}
+		err = pw.Write(string(row))
+		if err != nil {
+			return err
+		}
+	}
+	return pw.WriteStop()
+}
+
+func parquetCodec(c Compression) parquet.CompressionCodec {
+	switch c {
+	case CompressionGzip:
+		return parquet.CompressionCodec_GZIP
+	case CompressionZstd:
+		return parquet.CompressionCodec_ZSTD
+	}
+	return parquet.CompressionCodec_SNAPPY
+}
+
+type fieldKind int
+
+const (
+	kindNull fieldKind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindString
+	kindObject
+)
+
+// parquetField is a node of the schema inferred from the JSON documents, arrays and fields
+// seen with conflicting types are stored as JSON text
+type parquetField struct {
+	kind   fieldKind
+	fields map[string]*parquetField
+}
+
+// merge widens the field type so it can hold v
+func (f *parquetField) merge(v interface{}) {
+	kind := kindOf(v)
+	switch {
+	case kind == kindNull:
+		return
+	case f.kind == kindNull:
+		f.kind = kind
+	case f.kind == kind:
+	case f.kind == kindInt && kind == kindFloat, f.kind == kindFloat && kind == kindInt:
+		f.kind = kindFloat
+	default:
+		f.kind = kindString
+		f.fields = nil
+	}
+	if f.kind != kindObject {
+		return
+	}
+	if f.fields == nil {
+		f.fields = make(map[string]*parquetField)
+	}
+	for name, child := range v.(map[string]interface{}) {
+		if !validColumnName(name) {
+			continue
+		}
+		field, ok := f.fields[name]
+		if !ok {
+			field = &parquetField{}
+			f.fields[name] = field
+		}
+		field.merge(child)
+	}
+}
+
+func kindOf(v interface{}) fieldKind {
+	switch t := v.(type) {
+	case nil:
+		return kindNull
+	case bool:
+		return kindBool
+	case json.Number:
+		if _, err := t.Int64(); err == nil {
+			return kindInt
+		}
+		return kindFloat
+	case map[string]interface{}:
+		return kindObject
+	}
+	return kindString // strings and arrays
+}
+
+// validColumnName filters out names the parquet schema tags can't represent
+func validColumnName(name string) bool {
+	return name != "" && name == strings.TrimSpace(name) && !strings.ContainsAny(name, ",=.")
+}
+
+// parquetSchema is the JSON schema definition understood by the parquet writer
+type parquetSchema struct {
+	Tag    string
+	Fields []*parquetSchema `json:",omitempty"`
+}
+
+func (f *parquetField) schema(name, repetition string) *parquetSchema {
+	s := &parquetSchema{}
+	switch f.kind {
+	case kindObject:
+		if len(f.fields) == 0 { // parquet groups need at least one column
+			f.kind = kindString
+			return f.schema(name, repetition)
+		}
+		s.Tag = fmt.Sprintf("name=%s, repetitiontype=%s", name, repetition)
+		for _, child := range f.names() {
+			s.Fields = append(s.Fields, f.fields[child].schema(child, "OPTIONAL"))
+		}
+	case kindBool:
+		s.Tag = fmt.Sprintf("name=%s, type=BOOLEAN, repetitiontype=%s", name, repetition)
+	case kindInt:
+		s.Tag = fmt.Sprintf("name=%s, type=INT64, repetitiontype=%s", name, repetition)
+	case kindFloat:
+		s.Tag = fmt.Sprintf("name=%s, type=DOUBLE, repetitiontype=%s", name, repetition)
+	default:
+		s.Tag = fmt.Sprintf("name=%s, type=UTF8, repetitiontype=%s", name, repetition)
+	}
+	return s
+}
+
+func (f *parquetField) names() []string {
+	names := make([]string, 0, len(f.fields))
+	for name := range f.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// conform converts a decoded document into the shape of the inferred schema
+func (f *parquetField) conform(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch f.kind {
+	case kindObject:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		out := make(map[string]interface{}, len(f.fields))
+		for name, field := range f.fields {
+			out[name] = field.conform(m[name])
+		}
+		return out
+	case kindString:
+		if s, ok := v.(string); ok {
+			return s
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(b)
+	}
+	return v
+}
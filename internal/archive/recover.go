@@ -0,0 +1,237 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+// parquetMagic starts and ends every complete parquet file
+var parquetMagic = []byte("PAR1")
+
+// Recover tidies up archive files left in the archive path by a previous run before anything is
+// written, partial records at the end of a file from a crash are cut off so the file can be appended
+// to, the part index and size are picked up again when an archive is opened for the same key and hour.
+// With publishOrphans files last written before the current hour's lateness window, which nothing
+// will append to again, are published as if they had been closed.
+func (a *Archives) Recover(publishOrphans bool) error {
+	a.Lock()
+	defer a.Unlock()
+	cutoff := time.Now().Truncate(time.Hour).Add(-a.Lateness)
+	return filepath.Walk(a.Path, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Size() == 0 || (a.CompletePath != "" && !strings.HasSuffix(filename, ".tmp")) {
+			return nil
+		}
+		logger := log.With().Str("filename", filename).Logger()
+		name := strings.TrimSuffix(filename, ".tmp")
+		orphan := info.ModTime().Before(cutoff) // nothing appends to it again
+		switch {
+		case orphan && !publishOrphans && !strings.HasSuffix(name, ".parquet"):
+			return nil
+		case strings.HasSuffix(name, ".log"):
+			err = truncatePartialRecord(filename, info.Size())
+		case strings.HasSuffix(name, ".log"+CompressionGzip.extension()):
+			err = recoverCompressed(filename, CompressionGzip)
+		case strings.HasSuffix(name, ".log"+CompressionZstd.extension()):
+			err = recoverCompressed(filename, CompressionZstd)
+		case strings.HasSuffix(name, ".parquet"):
+			if !completeParquet(filename) { // the documents were only in memory, nothing to salvage
+				logger.Error().Msg("recover: moving aside incomplete parquet file")
+				archivesRecovered.WithLabelValues("corrupt").Inc()
+				return os.Rename(filename, filename+".corrupt")
+			}
+		default:
+			return nil
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("recover: failed to recover archive")
+			return err
+		}
+		if !publishOrphans || !orphan {
+			return nil
+		}
+		rel, err := filepath.Rel(a.Path, name)
+		if err != nil {
+			return err
+		}
+		arch := &Archive{path: a.Path, completePath: a.CompletePath, onComplete: a.OnComplete, name: filepath.ToSlash(rel), filename: filename, logger: logger}
+		logger.Info().Time("modified", info.ModTime()).Msg("recover: publishing archive from a previous run")
+		archivesRecovered.WithLabelValues("orphan").Inc()
+		return arch.publish()
+	})
+}
+
+// truncatePartialRecord cuts a newline delimited file back to the end of its last complete record
+func truncatePartialRecord(filename string, size int64) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	end := size
+	buf := make([]byte, 64*1024)
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == size {
+		return nil
+	}
+	log.Info().Str("filename", filename).Int64("size", size).Int64("truncated_size", end).Msg("recover: truncating partial record")
+	archivesRecovered.WithLabelValues("truncated").Inc()
+	err = f.Truncate(end)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// recoverCompressed recompresses the complete records of a file whose last member or frame is unfinished
+func recoverCompressed(filename string, c Compression) error {
+	var tail lastByte
+	err := decompressFile(&tail, filename, c)
+	if err == nil && (tail.n == 0 || tail.last == '\n') {
+		return nil
+	}
+	log.Info().Err(err).Str("filename", filename).Int64("decoded_bytes", tail.n).Msg("recover: rewriting incomplete compressed archive")
+	archivesRecovered.WithLabelValues("truncated").Inc()
+	tmp, err := ioutil.TempFile(path.Dir(filename), ".recover")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	out, err := newEncoder(c, 0, tmp)
+	if err == nil {
+		records := &completeRecords{w: out}
+		decompressFile(records, filename, c) // stops at the unfinished member or frame
+		err = records.err
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// decompressFile decodes as much of a compressed file as it can into w
+func decompressFile(w io.Writer, filename string, c Compression) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return decompress(w, f, c)
+}
+
+// lastByte keeps the last byte written and how many there were
+type lastByte struct {
+	last byte
+	n    int64
+}
+
+func (l *lastByte) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		l.last = p[len(p)-1]
+		l.n = l.n + int64(len(p))
+	}
+	return len(p), nil
+}
+
+// completeRecords passes on newline terminated records, holding back a partial one until it ends
+type completeRecords struct {
+	w       io.Writer
+	partial []byte
+	err     error // from writing to w, decoding errors are expected
+}
+
+func (r *completeRecords) Write(p []byte) (int, error) {
+	i := bytes.LastIndexByte(p, '\n')
+	if i < 0 {
+		r.partial = append(r.partial, p...)
+		return len(p), nil
+	}
+	if len(r.partial) > 0 {
+		if _, r.err = r.w.Write(r.partial); r.err != nil {
+			return 0, r.err
+		}
+		r.partial = r.partial[:0]
+	}
+	if _, r.err = r.w.Write(p[:i+1]); r.err != nil {
+		return 0, r.err
+	}
+	r.partial = append(r.partial, p[i+1:]...)
+	return len(p), nil
+}
+
+// decompress decodes as much of a compressed stream as it can, returning the error it stopped at
+func decompress(w io.Writer, r io.Reader, c Compression) error {
+	switch c {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, gz)
+		return err
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		_, err = io.Copy(w, zr)
+		return err
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// completeParquet checks a parquet file has its footer
+func completeParquet(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	if info.Size() < int64(2*len(parquetMagic)) {
+		return false
+	}
+	tail := make([]byte, len(parquetMagic))
+	_, err = f.ReadAt(tail, info.Size()-int64(len(tail)))
+	return err == nil && bytes.Equal(tail, parquetMagic)
+}
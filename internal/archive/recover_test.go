@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ArchivesRecover(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression Compression
+	}{
+		{name: "plain", compression: CompressionNone},
+		{name: "gzip", compression: CompressionGzip},
+		{name: "zstd", compression: CompressionZstd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "archive")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			filename := filepath.Join(dir, "part-00.log"+tt.compression.extension())
+			f, err := os.Create(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := newEncoder(tt.compression, 0, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a crash after flushing two records, in the middle of writing the third
+			out.Write([]byte("{\"id\":1}\n{\"id\":2}\n"))
+			out.Flush()
+			out.Write([]byte(`{"id":`))
+			if tt.compression == CompressionNone {
+				out.Flush()
+			}
+			f.Close()
+			a := New(1 << 20)
+			a.Path = dir
+			if err := a.Recover(false); err != nil {
+				t.Fatalf("Recover() error = %v", err)
+			}
+			got := readLines(t, filename, tt.compression)
+			want := []string{`{"id":1}`, `{"id":2}`}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("recovered %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_ArchivesRecoverSkipsOld(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "part-00.log.gz")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := newEncoder(CompressionGzip, 0, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("{\"id\":1}\n{\"id\":"))
+	out.Flush()
+	f.Close()
+	before, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-3 * time.Hour)
+	if err := os.Chtimes(filename, old, old); err != nil {
+		t.Fatal(err)
+	}
+	a := New(1 << 20)
+	a.Path = dir
+	if err := a.Recover(false); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	after, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("expected a file for an hour that is over to be left alone")
+	}
+}
+
+func Test_ArchivesRecoverResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	partition := filepath.Join(dir, "topic=test", "dt="+now.Format("2006-01-02"), "hour="+now.Format("15"), "accountUID=abc")
+	if err := os.MkdirAll(partition, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a previous run rotated to part 01 and crashed part way through a record
+	full := bytes.Repeat([]byte("{\"id\":0}\n"), 100)
+	if err := ioutil.WriteFile(filepath.Join(partition, "part-00.log"), full, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(partition, "part-01.log"), []byte("{\"id\":1}\n{\"id\""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a := New(len(full))
+	a.Path = dir
+	a.Layout = LayoutHive
+	if err := a.Recover(false); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := a.Write("test", "abc", time.Time{}, nil, []byte(`{"id":2}`)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := a.CloseAll(); err != nil {
+		t.Fatalf("CloseAll() error = %v", err)
+	}
+	for part, want := range map[string]int{"part-00.log": 100, "part-01.log": 99, "part-02.log": 2} {
+		if got := len(readLines(t, filepath.Join(partition, part), CompressionNone)); got != want {
+			t.Errorf("%v has %d documents, want %d", part, got, want)
+		}
+	}
+}
+
+func Test_ArchivesRecoverOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	working := filepath.Join(dir, "working")
+	complete := filepath.Join(dir, "complete")
+	old := time.Now().Add(-3 * time.Hour)
+	for name, modified := range map[string]time.Time{"old.log.tmp": old, "current.log.tmp": time.Now(), "corrupt.parquet.tmp": old} {
+		filename := filepath.Join(working, "sub", name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte("{\"id\":1}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var published []string
+	a := New(1 << 20)
+	a.Path = working
+	a.CompletePath = complete
+	a.OnComplete = func(filename string) { published = append(published, filename) }
+	if err := a.Recover(true); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	if want := []string{filepath.Join(complete, "sub", "old.log")}; fmt.Sprint(published) != fmt.Sprint(want) {
+		t.Errorf("published %v, want %v", published, want)
+	}
+	for _, name := range []string{"current.log.tmp", "corrupt.parquet.tmp.corrupt"} {
+		if _, err := os.Stat(filepath.Join(working, "sub", name)); err != nil {
+			t.Errorf("expected %v to be left in the archive path: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Filename templates for the built in layouts, the defaults keep the accountUID= naming
+// existing Athena tables were created with
+const (
+	flatTemplate = "topic={{.Topic}}_dt={{.DateTime}}_accountUID={{.Key}}_part={{.Part}}"
+	hiveTemplate = "topic={{.Topic}}/dt={{.Date}}/hour={{.Hour}}/accountUID={{.Key}}/part-{{.Part}}"
+)
+
+const dateTimeFormat = "2006-01-02T15:00Z"
+
+// FilenameData is what filename templates are rendered with, the file extension is
+// added after rendering
+type FilenameData struct {
+	Topic    string            // topic being archived
+	KeyName  string            // what the documents are partitioned on, e.g. accountUid
+	Key      string            // value of the key for this archive
+	Time     time.Time         // start of the hour the archive is for
+	DateTime string            // 2006-01-02T15:00Z
+	Date     string            // 2006-01-02
+	Year     string            // 2006
+	Month    string            // 01
+	Day      string            // 02
+	Hour     string            // 15
+	Hostname string            // host the archiver is running on
+	Index    int               // part index, incremented on size rotation
+	Part     string            // part index zero padded to two digits
+	Headers  map[string]string // headers merged into the documents, see Header
+}
+
+// Header returns the value of a merged header or undef, for use in templates as {{.Header "esn"}}
+func (d FilenameData) Header(name string) string {
+	if v, ok := d.Headers[strings.ToLower(name)]; ok && v != "" {
+		return v
+	}
+	return "undef"
+}
+
+// FilenameTemplate renders archive filenames relative to the archive path, slashes create directories
+type FilenameTemplate struct {
+	text     string
+	tmpl     *template.Template
+	hostname string
+}
+
+// NewFilenameTemplate parses and validates a filename template, it has to render a relative
+// path that changes with the key, the hour and the part index so archives never collide
+func NewFilenameTemplate(text string) (*FilenameTemplate, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	t := &FilenameTemplate{text: text, hostname: hostname}
+	t.tmpl, err = template.New("filename").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename template: %v", err)
+	}
+	err = t.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename template %q: %v", text, err)
+	}
+	return t, nil
+}
+
+// layoutTemplates are the filename templates for the built in layouts
+var layoutTemplates = map[Layout]*FilenameTemplate{}
+
+func init() {
+	for layout, text := range map[Layout]string{LayoutFlat: flatTemplate, LayoutHive: hiveTemplate} {
+		t, err := NewFilenameTemplate(text)
+		if err != nil {
+			panic(err)
+		}
+		layoutTemplates[layout] = t
+	}
+}
+
+// String returns the template text
+func (t *FilenameTemplate) String() string {
+	return t.text
+}
+
+func (t *FilenameTemplate) validate() error {
+	hour := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+	base, err := t.render("topic", "key", "value", hour, 0, nil)
+	if err != nil {
+		return err
+	}
+	if base == "" || path.IsAbs(base) || path.Clean(base) != base || strings.HasPrefix(base, "..") {
+		return fmt.Errorf("must render a clean relative path, got %q", base)
+	}
+	checks := []struct {
+		what string
+		name func() (string, error)
+	}{
+		{"key", func() (string, error) { return t.render("topic", "key", "other", hour, 0, nil) }},
+		{"hour", func() (string, error) { return t.render("topic", "key", "value", hour.Add(time.Hour), 0, nil) }},
+		{"part index", func() (string, error) { return t.render("topic", "key", "value", hour, 1, nil) }},
+	}
+	for _, check := range checks {
+		name, err := check.name()
+		if err != nil {
+			return err
+		}
+		if name == base {
+			return fmt.Errorf("filename must include the %s", check.what)
+		}
+	}
+	return nil
+}
+
+func (t *FilenameTemplate) render(topic, keyName, key string, hour time.Time, index int, headers map[string]string) (string, error) {
+	clean := make(map[string]string, len(headers))
+	for k, v := range headers {
+		clean[k] = cleanPathValue(v)
+	}
+	data := FilenameData{
+		Topic:    cleanPathValue(topic),
+		KeyName:  cleanPathValue(keyName),
+		Key:      cleanPathValue(key),
+		Time:     hour,
+		DateTime: hour.Format(dateTimeFormat),
+		Date:     hour.Format("2006-01-02"),
+		Year:     hour.Format("2006"),
+		Month:    hour.Format("01"),
+		Day:      hour.Format("02"),
+		Hour:     hour.Format("15"),
+		Hostname: t.hostname,
+		Index:    index,
+		Part:     fmt.Sprintf("%02d", index),
+		Headers:  clean,
+	}
+	var buf bytes.Buffer
+	err := t.tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// cleanPathValue stops values from the messages adding or escaping directories
+func cleanPathValue(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, v)
+	if v == "." || v == ".." {
+		return "_"
+	}
+	return v
+}
@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_NewFilenameTemplate(t *testing.T) {
+	hour := time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		template string
+		headers  map[string]string
+		key      string
+		index    int
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "flat default",
+			template: flatTemplate,
+			key:      "abc",
+			index:    1,
+			want:     "topic=test_dt=2026-10-18T13:00Z_accountUID=abc_part=01",
+		},
+		{
+			name:     "hive default",
+			template: hiveTemplate,
+			key:      "abc",
+			want:     "topic=test/dt=2026-10-18/hour=13/accountUID=abc/part-00",
+		},
+		{
+			name:     "key name and headers",
+			template: "{{.Topic}}/{{.Year}}/{{.Month}}/{{.Day}}/{{.Hour}}/{{.KeyName}}={{.Key}}/esn={{.Header \"ESN\"}}/{{.Header \"platform\"}}-{{.Index}}",
+			headers:  map[string]string{"esn": "123"},
+			key:      "abc",
+			want:     "test/2026/10/18/13/deviceUid=abc/esn=123/undef-0",
+		},
+		{
+			name:     "values can't escape the archive path",
+			template: hiveTemplate,
+			key:      "../../etc",
+			want:     "topic=test/dt=2026-10-18/hour=13/accountUID=.._.._etc/part-00",
+		},
+		{
+			name:     "syntax error",
+			template: "topic={{.Topic",
+			wantErr:  true,
+		},
+		{
+			name:     "unknown field",
+			template: "{{.Nope}}_{{.Key}}_{{.DateTime}}_{{.Part}}",
+			wantErr:  true,
+		},
+		{
+			name:     "missing part index",
+			template: "topic={{.Topic}}_dt={{.DateTime}}_{{.Key}}",
+			wantErr:  true,
+		},
+		{
+			name:     "missing hour",
+			template: "topic={{.Topic}}_dt={{.Date}}_{{.Key}}_{{.Part}}",
+			wantErr:  true,
+		},
+		{
+			name:     "missing key",
+			template: "topic={{.Topic}}_dt={{.DateTime}}_{{.Part}}",
+			wantErr:  true,
+		},
+		{
+			name:     "absolute path",
+			template: "/tmp/{{.Key}}_{{.DateTime}}_{{.Part}}",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := NewFilenameTemplate(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewFilenameTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := tmpl.render("test", "deviceUid", tt.key, hour, tt.index, tt.headers)
+			if err != nil {
+				t.Fatalf("render() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("render() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package consumer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// When messages are acked, anything other than AckPolicyWrite waits for the archive to be synced to disk
+const (
+	AckPolicyWrite    = "write"    // ack as soon as the document is written, it may only be in the page cache
+	AckPolicyMessage  = "message"  // sync and ack every message
+	AckPolicyCount    = "count"    // sync and ack every AckCount messages
+	AckPolicyInterval = "interval" // sync and ack every AckInterval
+	AckPolicyRotation = "rotation" // ack once the archive has been rotated or closed, no extra syncs, sinks that can't tell sync every AckInterval
+)
+
+// How deferred acks are sent to the broker
+const (
+	AckModeIndividual = "client-individual" // every message is acked, in a transaction when there are several
+	AckModeCumulative = "client"            // acking a message acks every message before it on the subscription
+)
+
+// DefaultPendingLimit is how many messages wait for acks before everything is made durable, when the
+// prefetch is the broker default of 1000
+const DefaultPendingLimit = 500
+
+// pendingAck is a message waiting for the documents written up to seq to be synced
+type pendingAck struct {
+	msg *stomp.Message
+	seq uint64
+}
+
+// ParseAckPolicy checks a command line value is a known ack policy
+func ParseAckPolicy(s string) (string, error) {
+	switch s {
+	case "":
+		return AckPolicyWrite, nil
+	case AckPolicyWrite, AckPolicyMessage, AckPolicyCount, AckPolicyInterval, AckPolicyRotation:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown ack policy: %v", s)
+}
+
+func (q *Queue) deferAcks() bool {
+	return q.AckPolicy != "" && q.AckPolicy != AckPolicyWrite
+}
+
+// ackMode is the subscription ack mode, cumulative acks are only safe when acks are deferred as
+// every message is then acked in order
+func (q *Queue) ackMode() stomp.AckMode {
+	if q.AckMode == AckModeCumulative && q.deferAcks() {
+		return stomp.AckClient
+	}
+	return stomp.AckClientIndividual
+}
+
+// ack acks a message once everything written before it is durable, straight away with AckPolicyWrite
+func (q *Queue) ack(sink Sink, msg *stomp.Message) error {
+	if !q.deferAcks() {
+		err := q.conn.Ack(msg)
+		if err != nil {
+			log.Error().Err(err).Msg("queue: failed to ack message")
+		}
+		return err
+	}
+	q.pending = append(q.pending, pendingAck{msg: msg, seq: q.written(sink)})
+	messagesPendingAck.With(prometheus.Labels{"topic": q.Topic}).Set(float64(len(q.pending)))
+	switch {
+	case q.AckPolicy == AckPolicyMessage,
+		q.AckPolicy == AckPolicyCount && len(q.pending) >= q.AckCount:
+		return q.FlushAndAck(sink)
+	case len(q.pending) >= q.pendingLimit():
+		return q.release(sink)
+	}
+	return nil
+}
+
+// pendingLimit is half the prefetch, leaving the broker room to keep sending while the acks go out
+func (q *Queue) pendingLimit() int {
+	if q.Prefetch <= 0 {
+		return DefaultPendingLimit
+	}
+	if q.Prefetch < 2 {
+		return 1
+	}
+	return q.Prefetch / 2
+}
+
+// release makes everything written so far durable and acks it, closing whatever a flush can't sync,
+// so delivery doesn't stall on the prefetch limit until a quiet archive is rotated or goes idle
+func (q *Queue) release(sink Sink) error {
+	err := q.FlushAndAck(sink)
+	if err != nil || len(q.pending) == 0 {
+		return err
+	}
+	c, ok := sink.(UnsyncedCloser)
+	if !ok {
+		return nil
+	}
+	log.Info().Str("topic", q.Topic).Int("pending", len(q.pending)).Msg("queue: closing unsynced archives to ack pending messages")
+	err = c.CloseUnsynced()
+	if err != nil {
+		return err
+	}
+	return q.AckDurable(sink)
+}
+
+// tick is called every AckInterval with deferred acks, archives may have been closed in the background
+func (q *Queue) tick(sink Sink) error {
+	if _, ok := sink.(DurableSink); q.AckPolicy == AckPolicyInterval || !ok {
+		return q.FlushAndAck(sink)
+	}
+	return q.AckDurable(sink)
+}
+
+// ackTicker ticks every AckInterval when acks are deferred, a nil channel otherwise
+func (q *Queue) ackTicker() (<-chan time.Time, func()) {
+	if !q.deferAcks() {
+		return nil, func() {}
+	}
+	interval := q.AckInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// FlushAndAck flushes the sink and acks the messages that are now durable
+func (q *Queue) FlushAndAck(sink Sink) error {
+	if len(q.pending) == 0 {
+		return nil
+	}
+	start := time.Now()
+	writes := q.writes
+	err := sink.Flush()
+	archiveSyncSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	q.flushed = writes
+	return q.AckDurable(sink)
+}
+
+// AckDurable acks the pending messages whose documents have been synced to disk, in a single
+// transaction or with a single cumulative ack
+func (q *Queue) AckDurable(sink Sink) error {
+	if len(q.pending) == 0 || q.conn == nil {
+		return nil
+	}
+	durable := q.durable(sink)
+	n := 0
+	for n < len(q.pending) && q.pending[n].seq <= durable {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	err := q.ackBatch(q.pending[:n])
+	if err != nil {
+		log.Error().Err(err).Int("messages", n).Msg("queue: failed to ack messages")
+		return err
+	}
+	log.Debug().Int("messages", n).Uint64("durable", durable).Msg("queue: acked durable messages")
+	ackBatchSize.Observe(float64(n))
+	q.pending = append(q.pending[:0], q.pending[n:]...)
+	messagesPendingAck.With(prometheus.Labels{"topic": q.Topic}).Set(float64(len(q.pending)))
+	return nil
+}
+
+func (q *Queue) ackBatch(batch []pendingAck) error {
+	if q.ackMode() == stomp.AckClient {
+		return q.conn.Ack(batch[len(batch)-1].msg)
+	}
+	if len(batch) == 1 {
+		return q.conn.Ack(batch[0].msg)
+	}
+	tx, err := q.conn.BeginWithError()
+	if err != nil {
+		return err
+	}
+	for _, p := range batch {
+		err = tx.Ack(p.msg)
+		if err != nil {
+			tx.Abort()
+			return err
+		}
+	}
+	return tx.CommitWithReceipt()
+}
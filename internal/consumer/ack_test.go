@@ -0,0 +1,247 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/jeks313/activemq-archiver/internal/archive"
+	"github.com/jeks313/activemq-archiver/internal/stomptest"
+)
+
+// messageFrames are n JSON messages with ids m-0 to m-(n-1)
+func messageFrames(n int) []*frame.Frame {
+	var messages []*frame.Frame
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("m-%d", i)
+		m := frame.New(frame.MESSAGE, frame.Destination, "/queue/Consumer.Archive.VirtualTopic.Usage", frame.MessageId, id, frame.Ack, id)
+		m.Body = []byte(fmt.Sprintf(`{"n":%d}`, i))
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// acks reads the ack frames the broker gets until n messages are acked and any transaction is committed
+func acks(t *testing.T, b *stomptest.Broker, n int) []string {
+	t.Helper()
+	var got []string
+	acked, open := 0, false
+	for acked < n || open {
+		select {
+		case f := <-b.Frames:
+			switch f.Command {
+			case frame.BEGIN:
+				open = true
+				got = append(got, "BEGIN")
+			case frame.COMMIT:
+				open = false
+				got = append(got, "COMMIT")
+			case frame.ACK:
+				acked++
+				ack := "ACK " + f.Header.Get(frame.Id)
+				if f.Header.Get(frame.Transaction) != "" {
+					ack += " in tx"
+				}
+				got = append(got, ack)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for acks, got %v", got)
+		}
+	}
+	return got
+}
+
+func Test_deferredAcks(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		mode        string
+		count       int
+		messages    int
+		wantAckMode string
+		want        []string
+	}{
+		{
+			name:        "every message",
+			policy:      AckPolicyMessage,
+			messages:    2,
+			wantAckMode: "client-individual",
+			want:        []string{"ACK m-0", "ACK m-1"},
+		},
+		{
+			name:        "count in transactions",
+			policy:      AckPolicyCount,
+			count:       3,
+			messages:    6,
+			wantAckMode: "client-individual",
+			want:        []string{"BEGIN", "ACK m-0 in tx", "ACK m-1 in tx", "ACK m-2 in tx", "COMMIT", "BEGIN", "ACK m-3 in tx", "ACK m-4 in tx", "ACK m-5 in tx", "COMMIT"},
+		},
+		{
+			name:        "count cumulative",
+			policy:      AckPolicyCount,
+			mode:        AckModeCumulative,
+			count:       3,
+			messages:    6,
+			wantAckMode: "client",
+			want:        []string{"ACK m-2", "ACK m-5"},
+		},
+		{
+			name:        "cumulative acks on write are individual",
+			policy:      AckPolicyWrite,
+			mode:        AckModeCumulative,
+			messages:    2,
+			wantAckMode: "client-individual",
+			want:        []string{"ACK m-0", "ACK m-1"},
+		},
+		{
+			name:        "interval",
+			policy:      AckPolicyInterval,
+			count:       100, // not reached, the tick acks
+			messages:    3,
+			wantAckMode: "client-individual",
+			want:        []string{"BEGIN", "ACK m-0 in tx", "ACK m-1 in tx", "ACK m-2 in tx", "COMMIT"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := stomptest.Start(t, &stomptest.Broker{Messages: messageFrames(tt.messages)})
+			defer b.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			q := New()
+			q.Ctx = ctx
+			q.Topic = "Usage"
+			q.Key = "n"
+			q.AckPolicy = tt.policy
+			q.AckMode = tt.mode
+			q.AckCount = tt.count
+			q.AckInterval = 200 * time.Millisecond
+			if err := q.Connect(b.Addr()); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer q.Close()
+			if err := q.Subscribe(q.Topic); err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+			if got := b.Next(t, frame.SUBSCRIBE).Header.Get(frame.Ack); got != tt.wantAckMode {
+				t.Errorf("expected ack mode %v, got %v", tt.wantAckMode, got)
+			}
+			done := make(chan error)
+			go func() { done <- q.Consume(&recordingSink{}) }()
+			got := acks(t, b, len(tt.want)-countOf(tt.want, "BEGIN")-countOf(tt.want, "COMMIT"))
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Consume() error = %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("acks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func countOf(list []string, s string) int {
+	n := 0
+	for _, v := range list {
+		if v == s {
+			n++
+		}
+	}
+	return n
+}
+
+func Test_resubscribeDropsPendingAcks(t *testing.T) {
+	b := stomptest.Start(t, &stomptest.Broker{Messages: messageFrames(2)})
+	defer b.Close()
+	q := New()
+	q.Topic = "Usage"
+	q.AckPolicy = AckPolicyCount
+	q.AckCount = 10
+	if err := q.Connect(b.Addr()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer q.Close()
+	if err := q.Subscribe(q.Topic); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	sink := &recordingSink{}
+	for i := 0; i < 2; i++ {
+		if err := q.ack(sink, <-q.sub.C); err != nil {
+			t.Fatalf("ack() error = %v", err)
+		}
+	}
+	if len(q.pending) != 2 {
+		t.Fatalf("expected 2 pending acks, got %d", len(q.pending))
+	}
+	// the broker redelivers what wasn't acked on the old subscription, so it must not be acked on the new one
+	if err := q.Subscribe(q.Topic); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if err := q.FlushAndAck(sink); err != nil {
+		t.Fatalf("FlushAndAck() error = %v", err)
+	}
+	q.Close()
+	b.Next(t, frame.SUBSCRIBE)
+	b.Next(t, frame.SUBSCRIBE)
+	for f := <-b.Frames; f.Command != frame.DISCONNECT; f = <-b.Frames {
+		if f.Command == frame.ACK || f.Command == frame.BEGIN {
+			t.Errorf("expected no acks after resubscribing, got %v %v", f.Command, f.Header.Get(frame.Id))
+		}
+	}
+}
+
+func Test_pendingLimitAcks(t *testing.T) {
+	tests := []struct {
+		name   string
+		format archive.Format
+	}{
+		{name: "json is synced", format: archive.FormatJSON},
+		{name: "parquet is closed", format: archive.FormatParquet},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := stomptest.Start(t, &stomptest.Broker{Messages: messageFrames(4)})
+			defer b.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			q := New()
+			q.Ctx = ctx
+			q.Topic = "Usage"
+			q.Key = "n" // every message has its own key so a quiet archive would hold up the acks
+			q.AckPolicy = AckPolicyRotation
+			q.AckInterval = time.Hour // the tick never comes
+			q.Prefetch = 4
+			if err := q.Connect(b.Addr()); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer q.Close()
+			if err := q.Subscribe(q.Topic); err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+			dir, err := ioutil.TempDir("", "pending")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			sink := archive.New(0)
+			sink.Path = dir
+			sink.Format = tt.format
+			defer sink.Close()
+			done := make(chan error)
+			go func() { done <- q.Consume(sink) }()
+			got := acks(t, b, 4)
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Consume() error = %v", err)
+			}
+			want := []string{"BEGIN", "ACK m-0 in tx", "ACK m-1 in tx", "COMMIT", "BEGIN", "ACK m-2 in tx", "ACK m-3 in tx", "COMMIT"}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("acks = %v, want %v", got, want)
+			}
+		})
+	}
+}
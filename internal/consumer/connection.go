@@ -0,0 +1,80 @@
+package consumer
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Connection states, logged and counted as the queue moves between them
+const (
+	StateConnecting   = "connecting"   // dialling a broker
+	StateSubscribed   = "subscribed"   // connected and consuming
+	StateFailed       = "failed"       // a broker couldn't be connected or subscribed to
+	StateDisconnected = "disconnected" // consuming stopped with an error, the connection is closed
+)
+
+// Run keeps the queue connected and consuming until the context is cancelled, leaving it subscribed
+func (q *Queue) Run(failover *Failover, sink Sink) {
+	logger := log.With().Str("topic", q.Topic).Logger()
+	for q.Ctx.Err() == nil {
+		broker := failover.broker()
+		q.transition(StateConnecting, broker, nil)
+		err := q.Connect(broker)
+		if err == nil {
+			err = q.Subscribe(q.Topic)
+			if err != nil {
+				q.Close()
+			}
+		}
+		if err != nil {
+			q.transition(StateFailed, broker, err)
+			if !q.backoff(failover) {
+				return
+			}
+			continue
+		}
+		failover.reset()
+		q.Hostname = broker
+		q.transition(StateSubscribed, broker, nil)
+
+		err = q.Consume(sink)
+		connectionUp.With(prometheus.Labels{"topic": q.Topic, "broker": broker}).Set(0)
+		if q.Ctx.Err() != nil { // shutting down, the subscription is closed once the archives are
+			return
+		}
+		q.transition(StateDisconnected, broker, err)
+		q.Close()
+		logger.Info().Msg("queue: waiting to re-connect")
+		if !q.backoff(failover) {
+			return
+		}
+	}
+}
+
+// transition logs and counts the queue moving to the state
+func (q *Queue) transition(state, broker string, err error) {
+	connectionTransitions.With(prometheus.Labels{"topic": q.Topic, "state": state}).Inc()
+	event := log.Info()
+	if err != nil {
+		event = log.Error().Err(err)
+	}
+	event.Str("topic", q.Topic).Str("broker", broker).Str("state", state).Msg("queue: connection " + state)
+	if state == StateSubscribed {
+		connectionUp.With(prometheus.Labels{"topic": q.Topic, "broker": broker}).Set(1)
+	}
+}
+
+// backoff waits before the next attempt, false when cancelled while waiting
+func (q *Queue) backoff(failover *Failover) bool {
+	delay := failover.backoff()
+	reconnectDelaySeconds.With(prometheus.Labels{"topic": q.Topic}).Set(delay.Seconds())
+	log.Debug().Str("topic", q.Topic).Dur("delay", delay).Msg("queue: backing off")
+	select {
+	case <-time.After(delay):
+		return true
+	case <-q.Ctx.Done():
+		return false
+	}
+}
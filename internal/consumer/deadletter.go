@@ -0,0 +1,148 @@
+package consumer
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Why a message couldn't be archived
+const (
+	ReasonUnknownContentType = "unknown_content_type" // no handler for the x-content-type header
+	ReasonBase64             = "base64"               // payload is not valid base64
+	ReasonZip                = "zip"                  // payload is not a valid zip file
+	ReasonCompression        = "compression"          // payload is not a valid gzip, zlib or deflate stream
+	ReasonInvalidJSON        = "invalid_json"         // payload is not a JSON object the headers can be merged into
+	ReasonDecode             = "decode"               // any other conversion failure
+)
+
+// Headers added to dead lettered messages
+const (
+	HeaderDeadLetterReason      = "x-archiver-reason"
+	HeaderDeadLetterError       = "x-archiver-error"
+	HeaderDeadLetterDestination = "x-archiver-original-destination"
+)
+
+var (
+	errUnknownContentType = errors.New("unhandled content type")
+	errNotJSONObject      = errors.New("payload is not a JSON object")
+)
+
+// DeadLetter is where messages that can't be converted go instead of being dropped, the broker
+// destination and the local quarantine archives can be used on their own or together
+type DeadLetter struct {
+	Destination string // broker destination the raw message is forwarded to, e.g. /queue/DLQ.Archive.MyTopic
+	Quarantine  Sink   // where the raw message is kept locally, e.g. archives partitioned by failure reason
+}
+
+// quarantined is what is written to the quarantine archives for a dead lettered message
+type quarantined struct {
+	Reason  string            `json:"reason"`
+	Error   string            `json:"error"`
+	Time    time.Time         `json:"time"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"` // base64 of the raw body, it couldn't be decoded after all
+}
+
+// failureReason classifies conversion errors for the dead letter metrics and headers
+func failureReason(err error) string {
+	var b64 base64.CorruptInputError
+	var deflate flate.CorruptInputError
+	switch {
+	case errors.Is(err, errUnknownContentType):
+		return ReasonUnknownContentType
+	case errors.As(err, &b64):
+		return ReasonBase64
+	case errors.Is(err, zip.ErrFormat), errors.Is(err, zip.ErrAlgorithm), errors.Is(err, zip.ErrChecksum):
+		return ReasonZip
+	case errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum),
+		errors.Is(err, zlib.ErrHeader), errors.Is(err, zlib.ErrChecksum), errors.Is(err, zlib.ErrDictionary),
+		errors.As(err, &deflate), errors.Is(err, io.ErrUnexpectedEOF):
+		return ReasonCompression
+	}
+	return ReasonDecode
+}
+
+// deadLetter forwards a message that couldn't be converted and/or quarantines it locally, it is only
+// dropped when neither is configured, an error means the message should not be acked
+func (q *Queue) deadLetter(msg *stomp.Message, reason string, cause error) error {
+	messagesDeadLettered.With(prometheus.Labels{"topic": q.Topic, "reason": reason}).Inc()
+	logger := log.With().Str("reason", reason).Str("error", cause.Error()).Str("destination", msg.Destination).Logger()
+	if q.DeadLetter.Destination == "" && q.DeadLetter.Quarantine == nil {
+		logger.Error().Msg("queue: dropping message that could not be converted")
+		return nil
+	}
+	if q.DeadLetter.Destination != "" {
+		err := q.conn.Send(q.DeadLetter.Destination, msg.ContentType, msg.Body, stomp.SendOpt.Receipt, deadLetterHeaders(msg, reason, cause))
+		if err != nil {
+			logger.Error().Err(err).Str("dead_letter_destination", q.DeadLetter.Destination).Msg("queue: failed to forward message to the dead letter destination")
+			return err
+		}
+		logger.Info().Str("dead_letter_destination", q.DeadLetter.Destination).Msg("queue: forwarded message to the dead letter destination")
+	}
+	if q.DeadLetter.Quarantine != nil {
+		doc, err := json.Marshal(quarantined{
+			Reason:  reason,
+			Error:   cause.Error(),
+			Time:    time.Now().UTC(),
+			Headers: allHeaders(msg),
+			Body:    base64.StdEncoding.EncodeToString(msg.Body),
+		})
+		if err == nil {
+			err = q.DeadLetter.Quarantine.Write(q.Topic, reason, time.Time{}, nil, doc)
+		}
+		if err == nil {
+			err = q.DeadLetter.Quarantine.Flush()
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("queue: failed to quarantine message")
+			return err
+		}
+		logger.Info().Msg("queue: quarantined message")
+	}
+	return nil
+}
+
+// deadLetterHeaders copies the application headers of the original message and adds why it failed
+func deadLetterHeaders(msg *stomp.Message, reason string, cause error) func(*frame.Frame) error {
+	return func(f *frame.Frame) error {
+		for i := 0; i < msg.Header.Len(); i++ {
+			k, v := msg.Header.GetAt(i)
+			switch k {
+			case frame.Destination, frame.MessageId, frame.Subscription, frame.Ack, frame.ContentLength, frame.ContentType, "redelivered":
+				continue
+			}
+			f.Header.Add(k, v)
+		}
+		f.Header.Set(HeaderDeadLetterReason, reason)
+		f.Header.Set(HeaderDeadLetterError, strings.Replace(cause.Error(), "\n", " ", -1))
+		f.Header.Set(HeaderDeadLetterDestination, msg.Destination)
+		return nil
+	}
+}
+
+func allHeaders(msg *stomp.Message) map[string]string {
+	headers := make(map[string]string, msg.Header.Len())
+	for i := 0; i < msg.Header.Len(); i++ {
+		k, v := msg.Header.GetAt(i)
+		headers[strings.ToLower(k)] = v
+	}
+	return headers
+}
+
+func unknownContentType(contentType string) error {
+	return fmt.Errorf("%w: %v", errUnknownContentType, contentType)
+}
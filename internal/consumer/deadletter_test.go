@@ -0,0 +1,150 @@
+package consumer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"github.com/jeks313/activemq-archiver/internal/archive"
+	"github.com/jeks313/activemq-archiver/internal/content"
+)
+
+func Test_conversionFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		decoder     bool // compose handlers for other content types
+		want        string
+	}{
+		{
+			name:        "unknown content type",
+			contentType: "gzip;json",
+			body:        `{"id":1}`,
+			want:        ReasonUnknownContentType,
+		},
+		{
+			name:        "bad base64",
+			contentType: "b64;zip;json",
+			body:        "not base64!",
+			want:        ReasonBase64,
+		},
+		{
+			name:        "corrupt zip",
+			contentType: "zip;json",
+			body:        "PK not really a zip file",
+			want:        ReasonZip,
+		},
+		{
+			name:        "unknown stage",
+			contentType: "b64;rar;json",
+			body:        `{"id":1}`,
+			decoder:     true,
+			want:        ReasonUnknownContentType,
+		},
+		{
+			name:        "corrupt gzip",
+			contentType: "gzip;json",
+			body:        "not gzipped",
+			decoder:     true,
+			want:        ReasonCompression,
+		},
+		{
+			name: "not a JSON object",
+			body: `["id", 1]`,
+			want: ReasonInvalidJSON,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New()
+			q.ContentTypeHeader = "x-content-type"
+			q.Handlers["zip;json"] = content.HandlerFromZipJSON
+			q.Handlers["b64;zip;json"] = content.HandlerFromBase64ZipJSON
+			if tt.decoder {
+				q.Decoder = func(contentType string) (ContentTypeHandler, error) {
+					d, err := content.Parse(contentType)
+					return ContentTypeHandler(d), err
+				}
+			}
+			headers := map[string]string{}
+			if tt.contentType != "" {
+				headers["x-content-type"] = tt.contentType
+			}
+			data, err := q.handleContentType(headers, []byte(tt.body))
+			reason := failureReason(err)
+			if err == nil {
+				_, err = mergeHeaders(data, headers)
+				reason = ReasonInvalidJSON
+			}
+			if err == nil {
+				t.Fatalf("expected the conversion to fail")
+			}
+			if reason != tt.want {
+				t.Errorf("reason = %v, want %v (%v)", reason, tt.want, err)
+			}
+		})
+	}
+}
+
+func Test_deadLetterQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	quarantine := archive.New(1 << 20)
+	quarantine.Path = dir
+	q := New()
+	q.Topic = "test"
+	q.DeadLetter.Quarantine = quarantine
+	body := []byte{0x50, 0x4b, 0xff, 0x00}
+	msg := &stomp.Message{
+		Destination: "/queue/Consumer.Archive.VirtualTopic.test",
+		Body:        body,
+		Header:      frame.NewHeader("message-id", "ID:1", "x-Content-Type", "zip;json", "esn", "123"),
+	}
+	if err := q.deadLetter(msg, ReasonZip, failureError(t)); err != nil {
+		t.Fatalf("deadLetter() error = %v", err)
+	}
+	if err := quarantine.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*accountUID=zip*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected a quarantine archive for the reason, got %v (%v)", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		t.Fatalf("quarantine archive is empty")
+	}
+	var got quarantined
+	if err := json.Unmarshal(s.Bytes(), &got); err != nil {
+		t.Fatalf("quarantined document is not JSON: %v", err)
+	}
+	if got.Reason != ReasonZip || got.Headers["esn"] != "123" || got.Headers["x-content-type"] != "zip;json" {
+		t.Errorf("quarantined %+v, missing reason or headers", got)
+	}
+	if raw, _ := base64.StdEncoding.DecodeString(got.Body); string(raw) != string(body) {
+		t.Errorf("quarantined body %q, want %q", raw, body)
+	}
+}
+
+func failureError(t *testing.T) error {
+	_, err := content.HandlerFromZipJSON([]byte("PK not really a zip file"))
+	if err == nil {
+		t.Fatal("expected a zip error")
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package consumer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Subscription types, how a topic name maps to the destination subscribed to
+const (
+	SubscriptionVirtualTopic = "virtual-topic" // the consumer queue of a virtual topic: /queue/Consumer.<Queue>.VirtualTopic.<topic>
+	SubscriptionQueue        = "queue"         // a queue by name: /queue/<topic>
+	SubscriptionDurable      = "durable-topic" // a durable subscription to a plain topic: /topic/<topic>
+)
+
+// DefaultConsumer is the virtual topic consumer name when Queue.Queue isn't set
+const DefaultConsumer = "Archive"
+
+// activemq headers identifying a durable subscription, the broker keeps the messages sent while the
+// client with the id is away for the subscription with the name
+const (
+	headerClientID         = "client-id"
+	headerSubscriptionName = "activemq.subscriptionName"
+)
+
+// ParseSubscription converts a command line value into a subscription type
+func ParseSubscription(s string) (string, error) {
+	switch s {
+	case "":
+		return SubscriptionVirtualTopic, nil
+	case SubscriptionVirtualTopic, SubscriptionQueue, SubscriptionDurable:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown subscription type: %v", s)
+}
+
+// ValidConsumer checks a virtual topic consumer name is a single destination element, activemq takes
+// everything between Consumer. and .VirtualTopic as the name, empty is the default
+func ValidConsumer(name string) error {
+	if strings.ContainsAny(name, ".*>/ ") {
+		return fmt.Errorf("invalid consumer name %q, it can't contain . * > / or spaces", name)
+	}
+	return nil
+}
+
+// destination is what Subscribe subscribes to for the topic, the topic can have activemq wildcards,
+// * for one element of the name and > for the rest of it, e.g. Device.* or Usage.>
+func (q *Queue) destination(topic string) string {
+	switch q.Subscription {
+	case SubscriptionQueue:
+		return "/queue/" + topic
+	case SubscriptionDurable:
+		return "/topic/" + topic
+	}
+	consumer := q.Queue
+	if consumer == "" {
+		consumer = DefaultConsumer
+	}
+	return fmt.Sprintf("/queue/Consumer.%s.VirtualTopic.%s", consumer, topic)
+}
+
+// Destination is what the queue subscribes to
+func (q *Queue) Destination() string {
+	return q.destination(q.Topic)
+}
+
+// IsWildcard is whether a topic name matches several destinations
+func IsWildcard(topic string) bool {
+	for _, element := range strings.Split(topic, ".") {
+		if element == "*" || element == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+// topicFromDestination is the topic name of the destination a message was sent to, used to archive messages
+// consumed through a wildcard under the topic they came from, without the virtual topic parts
+func topicFromDestination(destination string) string {
+	name := destination
+	for _, prefix := range []string{"/queue/", "/topic/"} {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	if strings.HasPrefix(name, "Consumer.") {
+		if i := strings.Index(name, ".VirtualTopic."); i >= 0 {
+			name = name[i+1:]
+		}
+	}
+	return strings.TrimPrefix(name, "VirtualTopic.")
+}
@@ -0,0 +1,88 @@
+package consumer
+
+import (
+	"testing"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/jeks313/activemq-archiver/internal/stomptest"
+)
+
+func Test_destination(t *testing.T) {
+	tests := []struct {
+		name         string
+		subscription string
+		consumer     string
+		topic        string
+		want         string
+	}{
+		{name: "default virtual topic", topic: "DeviceEvents", want: "/queue/Consumer.Archive.VirtualTopic.DeviceEvents"},
+		{name: "consumer name", subscription: SubscriptionVirtualTopic, consumer: "StagingArchive", topic: "DeviceEvents", want: "/queue/Consumer.StagingArchive.VirtualTopic.DeviceEvents"},
+		{name: "virtual topic wildcard", topic: "Device.>", want: "/queue/Consumer.Archive.VirtualTopic.Device.>"},
+		{name: "queue", subscription: SubscriptionQueue, topic: "Legacy.Usage", want: "/queue/Legacy.Usage"},
+		{name: "durable topic", subscription: SubscriptionDurable, topic: "Legacy.Usage", want: "/topic/Legacy.Usage"},
+		{name: "queue wildcard", subscription: SubscriptionQueue, consumer: "Ignored", topic: "Legacy.*", want: "/queue/Legacy.*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New()
+			q.Subscription = tt.subscription
+			q.Queue = tt.consumer
+			if got := q.destination(tt.topic); got != tt.want {
+				t.Errorf("destination() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_topicFromDestination(t *testing.T) {
+	tests := []struct {
+		destination string
+		want        string
+	}{
+		{destination: "/queue/Consumer.Archive.VirtualTopic.Device.Events", want: "Device.Events"},
+		{destination: "/topic/VirtualTopic.Device.Events", want: "Device.Events"},
+		{destination: "/queue/Legacy.Usage", want: "Legacy.Usage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			if got := topicFromDestination(tt.destination); got != tt.want {
+				t.Errorf("topicFromDestination() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !IsWildcard("Device.>") || !IsWildcard("*.Events") || IsWildcard("Device>Events") {
+		t.Errorf("IsWildcard() expects * and > as whole elements of the name")
+	}
+}
+
+func Test_durableSubscription(t *testing.T) {
+	b := stomptest.Start(t, &stomptest.Broker{})
+	defer b.Close()
+	q := New()
+	q.Topic = "Legacy.Usage"
+	q.Subscription = SubscriptionDurable
+	q.ClientID = "activemq-archiver.Legacy.Usage"
+	q.SubscriptionName = "Archive"
+	if err := q.Connect(b.Addr()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	if got := b.Next(t, frame.CONNECT).Header.Get(headerClientID); got != q.ClientID {
+		t.Errorf("expected the connect to have client-id %v, got %q", q.ClientID, got)
+	}
+	if err := q.Subscribe(q.Topic); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	sub := b.Next(t, frame.SUBSCRIBE)
+	if got := sub.Header.Get(frame.Destination); got != "/topic/Legacy.Usage" {
+		t.Errorf("expected a subscription to the topic, got %v", got)
+	}
+	if got := sub.Header.Get(headerSubscriptionName); got != "Archive" {
+		t.Errorf("expected the subscription to be named Archive, got %q", got)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := b.Next(t, frame.UNSUBSCRIBE).Header.Get(headerSubscriptionName); got != "" {
+		t.Errorf("expected the durable subscription to be kept on close, unsubscribe named %q", got)
+	}
+}
@@ -0,0 +1,122 @@
+package consumer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failover is the brokers a queue connects to and how long to back off between attempts
+type Failover struct {
+	Brokers    []string      // addresses as taken by Queue.Connect
+	Randomize  bool          // pick the next broker at random instead of in order
+	Delay      time.Duration // delay before the first reconnect
+	MaxDelay   time.Duration // longest delay between attempts
+	Multiplier float64       // how much the delay grows with each failed attempt
+	Jitter     float64       // fraction of the delay added or taken off at random so consumers don't reconnect in step
+	attempts   int
+	next       int
+	rand       *rand.Rand
+}
+
+// ParseFailover parses a host:port or a failover:(a,b,c)?options broker address
+func ParseFailover(address string, defaults Failover) (*Failover, error) {
+	f := defaults
+	f.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	if !strings.HasPrefix(address, "failover:") {
+		f.Brokers = []string{address}
+		return &f, f.validate()
+	}
+	list, query := strings.TrimPrefix(address, "failover:"), ""
+	if strings.HasPrefix(list, "(") {
+		end := strings.Index(list, ")")
+		if end < 0 {
+			return nil, fmt.Errorf("failover %v: missing )", address)
+		}
+		list, query = list[1:end], strings.TrimPrefix(list[end+1:], "?")
+	} else if i := strings.Index(list, "?"); i >= 0 {
+		list, query = list[:i], list[i+1:]
+	}
+	for _, broker := range strings.Split(list, ",") {
+		broker = strings.TrimSpace(broker)
+		if i := strings.Index(broker, "?"); i >= 0 { // transport options are for java clients
+			broker = broker[:i]
+		}
+		if broker != "" {
+			f.Brokers = append(f.Brokers, broker)
+		}
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("failover %v: %w", address, err)
+	}
+	for name := range values {
+		value := values.Get(name)
+		switch name {
+		case "randomize":
+			f.Randomize, err = strconv.ParseBool(value)
+		case "initialReconnectDelay":
+			f.Delay, err = parseMillis(value)
+		case "maxReconnectDelay":
+			f.MaxDelay, err = parseMillis(value)
+		case "backOffMultiplier":
+			f.Multiplier, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failover %v: invalid %v: %w", address, name, err)
+		}
+	}
+	return &f, f.validate()
+}
+
+func parseMillis(value string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	return time.Duration(ms) * time.Millisecond, err
+}
+
+func (f *Failover) validate() error {
+	if len(f.Brokers) == 0 {
+		return fmt.Errorf("no brokers to connect to")
+	}
+	if f.Delay <= 0 || f.MaxDelay < f.Delay {
+		return fmt.Errorf("the reconnect delay must be more than 0 and no more than the max delay")
+	}
+	if f.Multiplier < 1 || f.Jitter < 0 || f.Jitter >= 1 {
+		return fmt.Errorf("the backoff multiplier must be at least 1 and the jitter between 0 and 1")
+	}
+	return nil
+}
+
+// broker is the broker to try next, moving on from the last one
+func (f *Failover) broker() string {
+	if f.Randomize && len(f.Brokers) > 1 {
+		return f.Brokers[f.rand.Intn(len(f.Brokers))]
+	}
+	broker := f.Brokers[f.next%len(f.Brokers)]
+	f.next++
+	return broker
+}
+
+// backoff is how long to wait before the next attempt, growing with each call until reset
+func (f *Failover) backoff() time.Duration {
+	delay := float64(f.Delay) * math.Pow(f.Multiplier, float64(f.attempts))
+	if delay > float64(f.MaxDelay) {
+		delay = float64(f.MaxDelay)
+	} else {
+		f.attempts++
+	}
+	delay += delay * f.Jitter * (2*f.rand.Float64() - 1)
+	return time.Duration(delay)
+}
+
+// reset starts the backoff over once connected, and stays on the broker that worked
+func (f *Failover) reset() {
+	f.attempts = 0
+	if f.next > 0 {
+		f.next--
+	}
+}
@@ -0,0 +1,164 @@
+package consumer
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/jeks313/activemq-archiver/internal/stomptest"
+)
+
+func Test_ParseFailover(t *testing.T) {
+	defaults := Failover{Randomize: true, Delay: time.Second, MaxDelay: 30 * time.Second, Multiplier: 2, Jitter: 0.2}
+	tests := []struct {
+		name    string
+		address string
+		want    Failover
+		wantErr bool
+	}{
+		{
+			name:    "single broker",
+			address: "localhost:61613",
+			want:    Failover{Brokers: []string{"localhost:61613"}, Randomize: true, Delay: time.Second, MaxDelay: 30 * time.Second, Multiplier: 2, Jitter: 0.2},
+		},
+		{
+			name:    "failover list with activemq options",
+			address: "failover:(tcp://a:61613,stomp+ssl://b:61614?wireFormat.maxInactivityDuration=0)?randomize=false&initialReconnectDelay=100&maxReconnectDelay=5000&backOffMultiplier=1.5&timeout=3000",
+			want:    Failover{Brokers: []string{"tcp://a:61613", "stomp+ssl://b:61614"}, Delay: 100 * time.Millisecond, MaxDelay: 5 * time.Second, Multiplier: 1.5, Jitter: 0.2},
+		},
+		{
+			name:    "failover list without parentheses",
+			address: "failover:a:61613,b:61613",
+			want:    Failover{Brokers: []string{"a:61613", "b:61613"}, Randomize: true, Delay: time.Second, MaxDelay: 30 * time.Second, Multiplier: 2, Jitter: 0.2},
+		},
+		{
+			name:    "unclosed list",
+			address: "failover:(a:61613,b:61613",
+			wantErr: true,
+		},
+		{
+			name:    "empty list",
+			address: "failover:()",
+			wantErr: true,
+		},
+		{
+			name:    "bad option",
+			address: "failover:(a:61613)?initialReconnectDelay=soon",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFailover(tt.address, defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFailover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got.rand = nil
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ParseFailover() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_FailoverBackoff(t *testing.T) {
+	f, err := ParseFailover("failover:(a,b,c)?randomize=false", Failover{Delay: time.Second, MaxDelay: 5 * time.Second, Multiplier: 2, Jitter: 0.1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		got := f.backoff()
+		if got < want*9/10 || got > want*11/10 {
+			t.Errorf("backoff() = %v, want %v within the jitter", got, want)
+		}
+	}
+	var order []string
+	for i := 0; i < 4; i++ {
+		order = append(order, f.broker())
+	}
+	if !reflect.DeepEqual(order, []string{"a", "b", "c", "a"}) {
+		t.Errorf("expected the brokers in order, got %v", order)
+	}
+	f.reset()
+	if got := f.backoff(); got > 1100*time.Millisecond {
+		t.Errorf("expected the backoff to start over after a reset, got %v", got)
+	}
+	if got := f.broker(); got != "a" {
+		t.Errorf("expected to stay on the broker that worked after a reset, got %v", got)
+	}
+}
+
+func Test_RunFailsOver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close() // nothing listening, connections are refused
+	mute := stomptest.Start(t, &stomptest.Broker{Mute: true})
+	defer mute.Close()
+	tests := []struct {
+		name string
+		down string
+	}{
+		{name: "connection refused", down: refused},
+		{name: "broker never answers", down: mute.Addr()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := stomptest.Start(t, &stomptest.Broker{})
+			defer b.Close()
+			f, err := ParseFailover("failover:("+tt.down+","+b.Addr()+")?randomize=false", Failover{Delay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Multiplier: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			q := New()
+			q.Ctx = ctx
+			q.Topic = "DeviceEvents"
+			q.ConnectTimeout = 100 * time.Millisecond
+			done := make(chan struct{})
+			go func() {
+				q.Run(f, &recordingSink{})
+				close(done)
+			}()
+			sub := b.Next(t, frame.SUBSCRIBE)
+			if got := sub.Header.Get(frame.Destination); got != "/queue/Consumer.Archive.VirtualTopic.DeviceEvents" {
+				t.Errorf("expected a subscription on the broker that is up, got %v", got)
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run() didn't stop when cancelled")
+			}
+			q.Close()
+		})
+	}
+}
+
+func Test_connectCancelled(t *testing.T) {
+	b := stomptest.Start(t, &stomptest.Broker{Mute: true})
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	q := New()
+	q.Ctx = ctx
+	q.ConnectTimeout = time.Minute
+	go func() {
+		<-b.Frames // the CONNECT, which is never answered
+		cancel()
+	}()
+	start := time.Now()
+	if err := q.Connect(b.Addr()); err == nil {
+		t.Fatalf("expected connecting to a broker that never answers to fail once cancelled")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("expected cancelling to interrupt the connect, took %v", took)
+	}
+}
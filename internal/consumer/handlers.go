@@ -2,3 +2,6 @@ package consumer
 
 // ContentTypeHandler takes care of data format translations from zipped, encoded or other data to JSON byte array
 type ContentTypeHandler func([]byte) ([]byte, error)
+
+// ContentTypeDecoder builds the handler for a content type, e.g. by composing the stages of b64;gzip;json
+type ContentTypeDecoder func(contentType string) (ContentTypeHandler, error)
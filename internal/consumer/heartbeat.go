@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errReadTimeout is when the broker has gone quiet for longer than the read timeout, heartbeats included
+var errReadTimeout = errors.New("nothing read from the broker within the read timeout")
+
+// activityConn records when the broker was last heard from, and when that was only a heartbeat, an EOL
+// on its own between frames, so a connection dropped by a load balancer can be noticed
+type activityConn struct {
+	net.Conn
+	lastRead      int64 // unix nanos, atomic
+	lastHeartbeat prometheus.Gauge
+}
+
+func newActivityConn(conn net.Conn, topic string) *activityConn {
+	return &activityConn{
+		Conn:          conn,
+		lastRead:      time.Now().UnixNano(),
+		lastHeartbeat: lastHeartbeatTimestamp.With(prometheus.Labels{"topic": topic}),
+	}
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		now := time.Now()
+		atomic.StoreInt64(&c.lastRead, now.UnixNano())
+		if isHeartbeat(p[:n]) {
+			c.lastHeartbeat.Set(float64(now.UnixNano()) / float64(time.Second))
+		}
+	}
+	return n, err
+}
+
+// idle is how long since anything was read
+func (c *activityConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+}
+
+func isHeartbeat(data []byte) bool {
+	for _, b := range data {
+		if b != '\n' && b != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// readTimeout is the read timeout on top of the one go-stomp keeps from the negotiated heartbeats
+func (q *Queue) readTimeout() time.Duration {
+	return q.ReadTimeout
+}
+
+// watchdog ticks while the read timeout is on, nil otherwise
+func (q *Queue) watchdog() (<-chan time.Time, func()) {
+	timeout := q.readTimeout()
+	if timeout <= 0 || q.activity == nil {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(timeout / 4)
+	return ticker.C, ticker.Stop
+}
@@ -0,0 +1,72 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/jeks313/activemq-archiver/internal/stomptest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_heartbeats(t *testing.T) {
+	tests := []struct {
+		name        string
+		broker      *stomptest.Broker
+		readTimeout time.Duration
+		wantErr     bool
+	}{
+		{
+			name:   "broker sending heartbeats",
+			broker: &stomptest.Broker{Heartbeat: 20 * time.Millisecond},
+		},
+		{
+			name:    "broker gone quiet",
+			broker:  &stomptest.Broker{Heartbeat: 20 * time.Millisecond, Silent: true},
+			wantErr: true,
+		},
+		{
+			name:   "broker declines heartbeats",
+			broker: &stomptest.Broker{},
+		},
+		{
+			name:        "read timeout without heartbeats",
+			broker:      &stomptest.Broker{},
+			readTimeout: 100 * time.Millisecond,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := stomptest.Start(t, tt.broker)
+			defer b.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			q := New()
+			q.Ctx = ctx
+			q.Topic = "Heartbeats" + tt.name
+			q.HeartBeatReceive = 50 * time.Millisecond
+			q.ReadTimeout = tt.readTimeout
+			q.heartBeatError = 30 * time.Millisecond
+			if err := q.Connect(b.Addr()); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer q.Close()
+			if got := b.Next(t, frame.CONNECT).Header.Get(frame.HeartBeat); got != "0,50" {
+				t.Errorf("expected to ask for heartbeats every 50ms, got %v", got)
+			}
+			if err := q.Subscribe(q.Topic); err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+			if err := q.Consume(&recordingSink{}); (err != nil) != tt.wantErr {
+				t.Errorf("Consume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			heartbeat := testutil.ToFloat64(lastHeartbeatTimestamp.With(prometheus.Labels{"topic": q.Topic}))
+			if sent := tt.broker.Heartbeat > 0 && !tt.broker.Silent; (heartbeat > 0) != sent {
+				t.Errorf("expected the last heartbeat gauge to be set only when heartbeats are sent, got %v", heartbeat)
+			}
+		})
+	}
+}
@@ -30,4 +30,113 @@ var (
 			"key",   // what key we are splitting the files on
 		},
 	)
+	messagesDeadLettered = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "messages_dead_lettered_count",
+			Help:      "Number of messages that could not be converted, forwarded to the dead letter destination, quarantined or dropped",
+		},
+		[]string{
+			"topic",  // what topic this is for
+			"reason", // why the message could not be converted
+		},
+	)
+	messagesPendingAck = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "messages_pending_ack",
+			Help:      "Number of messages written and waiting for the archive to be synced before they are acked",
+		},
+		[]string{
+			"topic", // what topic this is for
+		},
+	)
+	ackBatchSize = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "ack_batch_size",
+			Help:      "Number of messages acked together once durable",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+		},
+	)
+	archiveSyncSeconds = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "archive_sync_seconds",
+			Help:      "Time taken to sync the archives to disk before acking",
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+	connectionTransitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "connection_transitions_count",
+			Help:      "Number of times the connection for the topic changed to the state",
+		},
+		[]string{
+			"topic", // what topic this is for
+			"state", // connecting, subscribed, failed or disconnected
+		},
+	)
+	connectionUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "connection_up",
+			Help:      "Whether the topic is subscribed to on a broker, 1 when it is",
+		},
+		[]string{
+			"topic",  // what topic this is for
+			"broker", // the broker connected to
+		},
+	)
+	reconnectDelaySeconds = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "reconnect_delay_seconds",
+			Help:      "Delay before the next attempt to connect to a broker for the topic",
+		},
+		[]string{
+			"topic", // what topic this is for
+		},
+	)
+	lastMessageTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "last_message_timestamp_seconds",
+			Help:      "When the last message was received for the topic",
+		},
+		[]string{
+			"topic", // what topic this is for
+		},
+	)
+	lastHeartbeatTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "last_heartbeat_timestamp_seconds",
+			Help:      "When the broker last sent a heartbeat on the connection for the topic",
+		},
+		[]string{
+			"topic", // what topic this is for
+		},
+	)
+	messagesInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "messages_in_flight",
+			Help:      "Number of messages received and being converted or waiting their turn to be written",
+		},
+		[]string{
+			"topic", // what topic this is for
+		},
+	)
 )
@@ -2,11 +2,16 @@ package consumer
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-stomp/stomp"
-	"github.com/jeks313/activemq-archiver/internal/archive"
+	"github.com/go-stomp/stomp/frame"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"github.com/tidwall/gjson"
@@ -16,106 +21,329 @@ import (
 
 // Queue represents an archive queue on a particular topic
 type Queue struct {
-	Hostname          string                        // activemq hostname: localhost:61613
+	Hostname          string                        // activemq hostname: localhost:61613, or stomp+ssl://host:61614 for TLS
+	Login             string                        // login sent on connect, when set
+	Passcode          string                        // passcode sent on connect
+	VHost             string                        // virtual host sent as the host header on connect, when set
+	TLS               *tls.Config                   // how stomp+ssl connections are verified, nil uses the system roots
+	HeartBeatSend     time.Duration                 // how often heartbeats are sent to the broker when there's nothing else to send, 0 is never
+	HeartBeatReceive  time.Duration                 // how often the broker is asked to send heartbeats, 0 is never
+	ReadTimeout       time.Duration                 // tear the connection down when nothing is read for this long, 0 leaves it to the negotiated heartbeats
+	ConnectTimeout    time.Duration                 // how long connecting, up to the broker's CONNECTED frame, may take, defaults to DefaultConnectTimeout
 	Handlers          map[string]ContentTypeHandler // translates data types to JSON byte arrays
+	Decoder           ContentTypeDecoder            // builds handlers for content types not in Handlers, nil only accepts Handlers
 	ContentTypeHeader string                        // header to use to control content type
-	Queue             string                        // queue: queue name, e.g. Archive
-	Topic             string                        // topic: topic name, e.g. MySuperDataTopic
+	Queue             string                        // queue: virtual topic consumer name, e.g. Archive for Consumer.Archive.VirtualTopic.X
+	Topic             string                        // topic: topic name, e.g. MySuperDataTopic, can be a wildcard
+	Subscription      string                        // how the topic name maps to a destination: virtual-topic, queue or durable-topic
+	ClientID          string                        // client-id of the connection for durable-topic, unique per connection
+	SubscriptionName  string                        // durable subscription name for durable-topic
 	Headers           []string                      // headers to include into the payload from the message
 	Key               string                        // key: what key to partition data on, assumes payload is JSON
+	TimeSource        string                        // where the event time comes from: arrival, payload or header
+	TimePath          string                        // JSON path of the event time in the payload
+	TimeHeader        string                        // header holding the event time, e.g. timestamp
+	TimeLayout        string                        // layout of the event time: unix, unixms or a go time layout, defaults to RFC3339
+	AckPolicy         string                        // when messages are acked: write, message, count, interval or rotation
+	AckCount          int                           // messages between syncs with AckPolicyCount
+	AckInterval       time.Duration                 // time between syncs with AckPolicyInterval, and checks for closed archives
+	AckMode           string                        // how deferred acks are sent: client-individual or client
+	DeadLetter        DeadLetter                    // where messages that can't be converted go
 	Ctx               context.Context
+	Workers           int        // messages converted at once, written in the order they arrived
+	Prefetch          int        // unacked messages the broker sends before waiting for acks, 0 is the broker default
+	settings          sync.Mutex // held while the settings are copied for a message, see Reconfigure
 	conn              *stomp.Conn
+	activity          *activityConn // when the broker was last heard from
+	heartBeatError    time.Duration // slack on the negotiated heartbeats before go-stomp gives up, its default when 0
 	sub               *stomp.Subscription
+	pending           []pendingAck // messages written but not acked yet
+	writes            uint64       // documents written to the sink
+	flushed           uint64       // documents written to the sink as of the last flush
 }
 
+// DefaultConnectTimeout is how long connecting may take when Queue.ConnectTimeout isn't set
+const DefaultConnectTimeout = 10 * time.Second
+
 func New() *Queue {
 	q := &Queue{}
 	q.Handlers = make(map[string]ContentTypeHandler)
 	return q
 }
 
-// Connect sets up the activemq connection
+// Connect sets up the activemq connection, over TLS for stomp+ssl:// addresses
 func (q *Queue) Connect(hostname string) error {
-	conn, err := stomp.Dial("tcp", hostname)
+	address, secure := parseAddress(hostname)
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	options := []func(*stomp.Conn) error{
+		stomp.ConnOpt.Host(host), // as stomp.Dial does, overridden by the vhost
+		stomp.ConnOpt.HeartBeat(q.HeartBeatSend, q.HeartBeatReceive),
+	}
+	if q.heartBeatError > 0 {
+		options = append(options, stomp.ConnOpt.HeartBeatError(q.heartBeatError))
+	}
+	if q.Login != "" {
+		options = append(options, stomp.ConnOpt.Login(q.Login, q.Passcode))
+	}
+	if q.VHost != "" {
+		options = append(options, stomp.ConnOpt.Host(q.VHost))
+	}
+	if q.Subscription == SubscriptionDurable {
+		options = append(options, stomp.ConnOpt.Header(headerClientID, q.ClientID))
+	}
+	ctx := q.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := q.ConnectTimeout
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	// go-stomp waits for CONNECTED without a deadline, so bound the handshakes and give up on cancel
+	netConn.SetDeadline(time.Now().Add(timeout))
+	connected, interrupted := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(interrupted)
+		select {
+		case <-ctx.Done():
+			netConn.SetDeadline(time.Now())
+		case <-connected:
+		}
+	}()
+	if secure {
+		config := q.TLS
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" { // as tls.Dial does
+			config = config.Clone()
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(netConn, config)
+		err = tlsConn.Handshake()
+		netConn = tlsConn
+	}
+	var conn *stomp.Conn
+	activity := newActivityConn(netConn, q.Topic)
+	if err == nil {
+		conn, err = stomp.Connect(activity, options...)
+	}
+	close(connected)
+	<-interrupted
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
+		if conn != nil {
+			conn.MustDisconnect()
+		}
+		netConn.Close()
 		return err
 	}
+	netConn.SetDeadline(time.Time{})
 	q.conn = conn
+	q.activity = activity
 	return nil
 }
 
-// Subscribe subscribes to the queue
+// Subscribe subscribes to the destination for the topic, see Subscription
 func (q *Queue) Subscribe(topic string) error {
-	t := fmt.Sprintf("/queue/Consumer.Archive.VirtualTopic.%s", topic)
-	sub, err := q.conn.Subscribe(t, stomp.AckClientIndividual)
+	destination := q.destination(topic)
+	log.Info().Str("destination", destination).Msg("queue: subscribing")
+	var options []func(*frame.Frame) error
+	if q.Subscription == SubscriptionDurable {
+		options = append(options, stomp.SubscribeOpt.Header(headerSubscriptionName, q.SubscriptionName))
+	}
+	if q.Prefetch > 0 {
+		options = append(options, stomp.SubscribeOpt.Header(headerPrefetchSize, strconv.Itoa(q.Prefetch)))
+	}
+	sub, err := q.conn.Subscribe(destination, q.ackMode(), options...)
 	if err != nil {
 		return err
 	}
 	q.sub = sub
+	q.pending = nil // anything not acked on a previous subscription is redelivered
+	messagesPendingAck.With(prometheus.Labels{"topic": q.Topic}).Set(0)
 	return nil
 }
 
-// Consume from the queue subscription
-func (q *Queue) Consume(arch *archive.Archives) error {
-	defer func() {
+// Reconfigure changes the conversion settings for new messages, replace slices and maps rather than edit them
+func (q *Queue) Reconfigure(update func(q *Queue)) {
+	q.settings.Lock()
+	defer q.settings.Unlock()
+	update(q)
+}
+
+// Close unsubscribes and disconnects from activemq, messages received but not acked are redelivered,
+// a durable subscription is kept by the broker since the unsubscribe doesn't name it
+func (q *Queue) Close() error {
+	var lastErr error
+	if q.sub != nil {
 		log.Info().Msg("queue: unsubscribing")
-		q.sub.Unsubscribe()
-	}()
-	defer func() {
+		err := q.sub.Unsubscribe()
+		if err != nil {
+			log.Error().Err(err).Msg("queue: failed to unsubscribe")
+			lastErr = err
+		}
+		q.sub = nil
+	}
+	if q.conn != nil {
 		log.Info().Msg("queue: disconnecting")
-		q.conn.Disconnect()
-	}()
-	var documentID int64
+		err := q.conn.Disconnect()
+		if err != nil {
+			log.Error().Err(err).Msg("queue: failed to disconnect")
+			lastErr = err
+		}
+		q.conn = nil
+		q.activity = nil
+	}
+	return lastErr
+}
+
+// Consume from the queue subscription, writing messages in the order they arrived
+func (q *Queue) Consume(sink Sink) error {
+	tick, stop := q.ackTicker()
+	defer stop()
+	watch, stopWatching := q.watchdog()
+	defer stopWatching()
+	lastMessage := lastMessageTimestamp.With(prometheus.Labels{"topic": q.Topic})
+	inFlight := messagesInFlight.With(prometheus.Labels{"topic": q.Topic})
+	jobs := make(chan *job, q.window())
+	defer close(jobs)
+	q.startWorkers(jobs)
+	var received []*job // in arrival order
+	defer inFlight.Set(0)
 	for {
+		receive := q.sub.C
+		if len(received) >= q.window() {
+			receive = nil
+		}
+		var converted chan struct{}
+		if len(received) > 0 {
+			converted = received[0].done
+		}
 		select {
 		case <-q.Ctx.Done():
-			log.Info().Msg("queue: cancellation received, stopping")
-			return nil
-		case msg := <-q.sub.C:
-			documentID = documentID + 1
-			if msg == nil {
-				log.Info().Msg("queue: received nil message, stopping")
-				return fmt.Errorf("consume: received error")
-			}
-			if msg.Err != nil {
-				log.Error().Err(msg.Err).Msg("consume: received error")
-				return msg.Err
-			}
-			headers := headersFromMessage(q.Headers, msg)
-			data, err := q.handleContentType(headers, msg.Body)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to convert message type")
-				err = q.conn.Ack(msg)
+			log.Info().Int("in_flight", len(received)).Msg("queue: cancellation received, stopping")
+			for _, j := range received {
+				<-j.done
+				err := q.write(sink, j)
 				if err != nil {
-					log.Error().Err(err).Msg("queue: failed to ack message")
 					return err
 				}
-				continue
 			}
-			headersAndData, err := sjson.SetBytes(data, "headers", headers)
-			headersAndDataNonPretty := pretty.UglyInPlace(headersAndData) // yes some of our payloads are pretty printed, sigh
+			return nil
+		case <-tick:
+			err := q.tick(sink)
 			if err != nil {
-				log.Error().Err(err).Msg("queue: failed to merge headers to payload")
 				return err
 			}
-			keyValue := fromJSON(headersAndDataNonPretty, q.Key)
-			if keyValue == "" {
-				keyValue = "undef"
+		case <-watch:
+			if idle := q.activity.idle(); idle > q.readTimeout() {
+				log.Error().Dur("idle", idle).Dur("read_timeout", q.readTimeout()).Msg("queue: nothing read from the broker within the read timeout, reconnecting")
+				return errReadTimeout
 			}
-			err = arch.Write(q.Topic, keyValue, headersAndDataNonPretty)
+		case <-converted:
+			j := received[0]
+			received[0] = nil
+			received = received[1:]
+			inFlight.Set(float64(len(received)))
+			err := q.write(sink, j)
 			if err != nil {
-				log.Error().Err(err).Msg("queue: failed to write document to archive")
 				return err
 			}
-			err = q.conn.Ack(msg)
-			if err != nil {
-				log.Error().Err(err).Msg("queue: failed to ack message")
-				return err
+		case msg := <-receive:
+			if msg == nil {
+				log.Info().Msg("queue: received nil message, stopping")
+				return fmt.Errorf("consume: received error")
 			}
-			messagesWritten.With(prometheus.Labels{"topic": q.Topic, "key": keyValue}).Inc()
-			messagesWrittenBytes.With(prometheus.Labels{"topic": q.Topic, "key": keyValue}).Add(float64(len(headersAndData)))
+			if msg.Err != nil {
+				log.Error().Err(msg.Err).Msg("consume: received error")
+				return msg.Err
+			}
+			lastMessage.SetToCurrentTime()
+			j := q.newJob(msg)
+			received = append(received, j)
+			inFlight.Set(float64(len(received)))
+			jobs <- j // never blocks, there are no more jobs than the window
+		}
+	}
+}
+
+// write writes a converted message to the sink and acks it, or dead letters it when it couldn't be converted
+func (q *Queue) write(sink Sink, j *job) error {
+	if j.err != nil {
+		log.Error().Err(j.err).Str("reason", j.reason).Msg("failed to convert message type")
+		err := q.deadLetter(j.msg, j.reason, j.err)
+		if err == nil {
+			err = q.ack(sink, j.msg)
 		}
+		return err
+	}
+	doc := j.doc
+	err := sink.Write(doc.topic, doc.key, doc.time, doc.headers, doc.data)
+	if err != nil {
+		log.Error().Err(err).Msg("queue: failed to write document to archive")
+		return err
+	}
+	q.writes = q.writes + 1
+	err = q.ack(sink, j.msg)
+	if err != nil {
+		return err
 	}
+	messagesWritten.With(prometheus.Labels{"topic": doc.topic, "key": doc.key}).Inc()
+	messagesWrittenBytes.With(prometheus.Labels{"topic": doc.topic, "key": doc.key}).Add(float64(doc.size))
+	return nil
+}
+
+// document is a message converted for the sink
+type document struct {
+	topic   string // the topic the message came from, for wildcard subscriptions
+	headers map[string]string
+	data    []byte
+	key     string
+	time    time.Time
+	size    int // size before the payload is compacted
+}
+
+// convert decodes the payload and merges the headers into it, on failure the reason is for dead lettering,
+// it's called by the workers on a copy of the settings, see newJob
+func (q *Queue) convert(msg *stomp.Message) (document, string, error) {
+	headers := headersFromMessage(q.Headers, msg)
+	data, err := q.handleContentType(headers, msg.Body)
+	if err != nil {
+		return document{}, failureReason(err), err
+	}
+	headersAndData, err := mergeHeaders(data, headers)
+	if err != nil {
+		return document{}, ReasonInvalidJSON, err
+	}
+	size := len(headersAndData)
+	headersAndDataNonPretty := pretty.UglyInPlace(headersAndData) // yes some of our payloads are pretty printed, sigh
+	keyValue := fromJSON(headersAndDataNonPretty, q.Key)
+	if keyValue == "" {
+		keyValue = "undef"
+	}
+	topic := q.Topic
+	if IsWildcard(topic) {
+		topic = topicFromDestination(msg.Destination)
+	}
+	return document{
+		topic:   topic,
+		headers: headers,
+		data:    headersAndDataNonPretty,
+		key:     keyValue,
+		time:    q.eventTime(msg, headersAndDataNonPretty),
+		size:    size,
+	}, "", nil
 }
 
 func (q *Queue) handleContentType(headers map[string]string, data []byte) ([]byte, error) {
@@ -126,12 +354,28 @@ func (q *Queue) handleContentType(headers map[string]string, data []byte) ([]byt
 			log.Debug().Str("content_type", contentType).Msg("handling data conversion")
 			return handler(data)
 		}
-		return data, fmt.Errorf("unhandled content type: %v", contentType)
+		if q.Decoder == nil {
+			return data, unknownContentType(contentType)
+		}
+		handler, err := q.Decoder(contentType)
+		if err != nil {
+			return data, fmt.Errorf("%w: %v", errUnknownContentType, err)
+		}
+		log.Debug().Str("content_type", contentType).Msg("handling data conversion")
+		return handler(data)
 	}
 	log.Debug().Str("content_type_header", q.ContentTypeHeader).Msg("no content type header found")
 	return data, nil
 }
 
+// mergeHeaders adds the headers to the payload under the headers key, the payload has to be a JSON object
+func mergeHeaders(data []byte, headers map[string]string) ([]byte, error) {
+	if !gjson.ValidBytes(data) || !gjson.ParseBytes(data).IsObject() {
+		return nil, errNotJSONObject
+	}
+	return sjson.SetBytes(data, "headers", headers)
+}
+
 func headersFromMessage(headersWanted []string, msg *stomp.Message) map[string]string {
 	headers := make(map[string]string)
 	headersToMerge := make(map[string]string)
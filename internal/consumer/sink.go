@@ -0,0 +1,91 @@
+package consumer
+
+import (
+	"time"
+
+	"github.com/jeks313/activemq-archiver/internal/archive"
+	"github.com/rs/zerolog/log"
+)
+
+// Sink is where consumed documents are written to
+type Sink interface {
+	// Write writes a document, key is the value of the partition key and t the event time, zero for now
+	Write(topic, key string, t time.Time, headers map[string]string, doc []byte) error
+	// Flush makes everything written so far durable
+	Flush() error
+	// Close flushes and releases everything, nothing is written after it
+	Close() error
+}
+
+// DurableSink is a sink that also makes documents durable on its own, e.g. when rotating files, and
+// reports how far it has got so acks don't have to wait for a flush
+type DurableSink interface {
+	Sink
+	Written() uint64 // sequence number of the last document written
+	Durable() uint64 // sequence number of the last document that, along with every one before it, is durable
+}
+
+// UnsyncedCloser is a sink that can close what a flush can't make durable, e.g. parquet files
+type UnsyncedCloser interface {
+	CloseUnsynced() error
+}
+
+var _ DurableSink = (*archive.Archives)(nil)
+var _ UnsyncedCloser = (*archive.Archives)(nil)
+
+// FanOut is a sink writing every document to each of its sinks in turn
+type FanOut []Sink
+
+// Write writes the document to every sink, stopping at the first that fails so the message isn't acked
+func (f FanOut) Write(topic, key string, t time.Time, headers map[string]string, doc []byte) error {
+	for _, s := range f {
+		err := s.Write(topic, key, t, headers, doc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush flushes every sink, returning the last error seen
+func (f FanOut) Flush() error {
+	var lastErr error
+	for _, s := range f {
+		err := s.Flush()
+		if err != nil {
+			log.Error().Err(err).Msg("sink: failed to flush")
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Close closes every sink, returning the last error seen
+func (f FanOut) Close() error {
+	var lastErr error
+	for _, s := range f {
+		err := s.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("sink: failed to close")
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// written is the sequence number of the last document written to the sink
+func (q *Queue) written(sink Sink) uint64 {
+	if d, ok := sink.(DurableSink); ok {
+		return d.Written()
+	}
+	return q.writes
+}
+
+// durable is the sequence number of the last document known to be durable, for sinks that can't
+// tell that's as far as the last flush got
+func (q *Queue) durable(sink Sink) uint64 {
+	if d, ok := sink.(DurableSink); ok {
+		return d.Durable()
+	}
+	return q.flushed
+}
@@ -0,0 +1,62 @@
+package consumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps documents in memory, failing writes once fail is set
+type recordingSink struct {
+	docs    []string
+	flushes int
+	closed  bool
+	fail    error
+}
+
+func (r *recordingSink) Write(topic, key string, t time.Time, headers map[string]string, doc []byte) error {
+	if r.fail != nil {
+		return r.fail
+	}
+	r.docs = append(r.docs, string(doc))
+	return nil
+}
+
+func (r *recordingSink) Flush() error {
+	r.flushes++
+	return nil
+}
+
+func (r *recordingSink) Close() error {
+	r.closed = true
+	return nil
+}
+
+func Test_FanOut(t *testing.T) {
+	first, second := &recordingSink{}, &recordingSink{}
+	sink := FanOut{first, second}
+	if err := sink.Write("test", "abc", time.Time{}, nil, []byte(`{"id":1}`)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	first.fail = errors.New("disk full")
+	if err := sink.Write("test", "abc", time.Time{}, nil, []byte(`{"id":2}`)); err == nil {
+		t.Errorf("expected a failing sink to fail the write")
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if len(first.docs) != 1 || len(second.docs) != 1 {
+		t.Errorf("expected each sink to have the first document only, got %v and %v", first.docs, second.docs)
+	}
+	if first.flushes != 1 || second.flushes != 1 || !first.closed || !second.closed {
+		t.Errorf("expected every sink to be flushed and closed")
+	}
+	q := New()
+	q.writes, q.flushed = 2, 1
+	if got := q.durable(sink); got != 1 {
+		t.Errorf("durable() = %d, want the writes as of the last flush", got)
+	}
+}
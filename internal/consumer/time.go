@@ -0,0 +1,69 @@
+package consumer
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/rs/zerolog/log"
+)
+
+// Where the time used to partition archives comes from
+const (
+	TimeSourceArrival = "arrival" // when the message was consumed
+	TimeSourcePayload = "payload" // a field in the JSON payload, see Queue.TimePath
+	TimeSourceHeader  = "header"  // a message header, see Queue.TimeHeader
+)
+
+// Time layouts for numeric timestamps, anything else is a go time layout
+const (
+	TimeLayoutUnix   = "unix"   // seconds since the epoch
+	TimeLayoutUnixMs = "unixms" // milliseconds since the epoch, as in the activemq timestamp header
+)
+
+// eventTime finds the time of the event, falling back to the arrival time if it's missing or
+// can't be parsed, the zero time means the arrival time to the archives
+func (q *Queue) eventTime(msg *stomp.Message, doc []byte) time.Time {
+	var value string
+	switch q.TimeSource {
+	case TimeSourcePayload:
+		value = fromJSON(doc, q.TimePath)
+	case TimeSourceHeader:
+		value = msg.Header.Get(q.TimeHeader)
+	default:
+		return time.Time{}
+	}
+	if value == "" {
+		log.Debug().Str("time_source", q.TimeSource).Msg("queue: no event time found, using arrival time")
+		return time.Time{}
+	}
+	t, err := parseTime(value, q.TimeLayout)
+	if err != nil {
+		log.Debug().Err(err).Str("time_source", q.TimeSource).Str("time", value).Msg("queue: unable to parse event time, using arrival time")
+		return time.Time{}
+	}
+	return t
+}
+
+func parseTime(value, layout string) (time.Time, error) {
+	switch layout {
+	case TimeLayoutUnix, TimeLayoutUnixMs:
+		unit := time.Second
+		if layout == TimeLayoutUnixMs {
+			unit = time.Millisecond
+		}
+		value = strings.TrimSpace(value)
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(0, i*int64(unit)), nil
+		}
+		f, err := strconv.ParseFloat(value, 64) // fractional timestamps
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(f*float64(unit))), nil
+	case "":
+		layout = time.RFC3339Nano
+	}
+	return time.Parse(layout, value)
+}
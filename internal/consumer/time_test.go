@@ -0,0 +1,58 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		layout  string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "default RFC3339",
+			value: "2026-10-18T13:04:05Z",
+			want:  time.Date(2026, 10, 18, 13, 4, 5, 0, time.UTC),
+		},
+		{
+			name:   "activemq timestamp header",
+			value:  "1792328645123",
+			layout: TimeLayoutUnixMs,
+			want:   time.Unix(1792328645, 123000000),
+		},
+		{
+			name:   "unix seconds",
+			value:  "1792328645",
+			layout: TimeLayoutUnix,
+			want:   time.Unix(1792328645, 0),
+		},
+		{
+			name:   "go layout",
+			value:  "2026-10-18 13:04",
+			layout: "2006-01-02 15:04",
+			want:   time.Date(2026, 10, 18, 13, 4, 0, 0, time.UTC),
+		},
+		{
+			name:    "garbage",
+			value:   "yesterday",
+			layout:  TimeLayoutUnixMs,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTime(tt.value, tt.layout)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseTime() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package consumer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// broker address schemes, an address without one is plain tcp
+const (
+	schemeTCP = "tcp://"
+	schemeSSL = "ssl://"
+)
+
+// TLSOptions are how the connection to a stomp+ssl broker is verified
+type TLSOptions struct {
+	CAFile     string // PEM bundle of the CAs the broker certificate is checked against, defaults to the system roots
+	CertFile   string // PEM client certificate, for brokers that require one
+	KeyFile    string // PEM key of the client certificate
+	ServerName string // name the broker certificate must have, defaults to the host being connected to
+}
+
+// Config loads the certificates into a tls config
+func (o TLSOptions) Config() (*tls.Config, error) {
+	c := &tls.Config{ServerName: o.ServerName}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %v", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// parseAddress splits a broker address into host:port and whether it's TLS, stomp+ssl://host:port
+// and ssl://host:port are TLS, tcp://host:port, stomp://host:port and host:port are not
+func parseAddress(address string) (string, bool) {
+	address = strings.TrimPrefix(address, "stomp+")
+	switch {
+	case strings.HasPrefix(address, schemeSSL):
+		return strings.TrimPrefix(address, schemeSSL), true
+	case strings.HasPrefix(address, "stomp://"):
+		return strings.TrimPrefix(address, "stomp://"), false
+	}
+	return strings.TrimPrefix(address, schemeTCP), false
+}
@@ -0,0 +1,197 @@
+package consumer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/jeks313/activemq-archiver/internal/stomptest"
+)
+
+// testCA signs certificates for the TLS stub broker and the client
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a certificate for the name, returning it and its key PEM encoded
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// newTLSStubBroker is a stub broker behind TLS with a certificate for broker.test that requires
+// a client certificate from the CA
+func newTLSStubBroker(t *testing.T, ca *testCA) *stomptest.Broker {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "broker.test", x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := x509.NewCertPool()
+	clients.AddCert(ca.cert)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stomptest.StartListener(&stomptest.Broker{}, l)
+}
+
+func Test_connectTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	b := newTLSStubBroker(t, ca)
+	defer b.Close()
+	_, port, _ := net.SplitHostPort(b.Addr())
+
+	write := func(name string, data []byte) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	caFile := write("ca.pem", ca.pem)
+	certPEM, keyPEM := ca.issue(t, "archiver", x509.ExtKeyUsageClientAuth)
+	certFile, keyFile := write("client.pem", certPEM), write("client-key.pem", keyPEM)
+
+	tests := []struct {
+		name    string
+		options TLSOptions
+		wantErr bool
+	}{
+		{
+			name:    "verified with a client certificate",
+			options: TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "broker.test"},
+		},
+		{
+			name:    "wrong server name",
+			options: TLSOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "other.test"},
+			wantErr: true,
+		},
+		{
+			name:    "broker not signed by a system root",
+			options: TLSOptions{CertFile: certFile, KeyFile: keyFile, ServerName: "broker.test"},
+			wantErr: true,
+		},
+		{
+			name:    "no client certificate",
+			options: TLSOptions{CAFile: caFile, ServerName: "broker.test"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.options.Config()
+			if err != nil {
+				t.Fatalf("Config() error = %v", err)
+			}
+			q := New()
+			q.TLS = config
+			q.Login = "archiver"
+			q.Passcode = "secret"
+			q.VHost = "archive"
+			err = q.Connect("stomp+ssl://127.0.0.1:" + port)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Connect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer q.Close()
+			f := b.Next(t, frame.CONNECT)
+			if f.Header.Get(frame.Login) != "archiver" || f.Header.Get(frame.Passcode) != "secret" || f.Header.Get(frame.Host) != "archive" {
+				t.Errorf("expected the connect to have the login, passcode and vhost, got %v", f.Header)
+			}
+		})
+	}
+}
+
+func Test_parseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		secure  bool
+	}{
+		{address: "localhost:61613", want: "localhost:61613"},
+		{address: "tcp://localhost:61613", want: "localhost:61613"},
+		{address: "stomp://localhost:61613", want: "localhost:61613"},
+		{address: "stomp+ssl://broker:61614", want: "broker:61614", secure: true},
+		{address: "ssl://broker:61614", want: "broker:61614", secure: true},
+	}
+	for _, tt := range tests {
+		got, secure := parseAddress(tt.address)
+		if got != tt.want || secure != tt.secure {
+			t.Errorf("parseAddress(%v) = %v, %v, want %v, %v", tt.address, got, secure, tt.want, tt.secure)
+		}
+	}
+}
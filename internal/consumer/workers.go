@@ -0,0 +1,67 @@
+package consumer
+
+import (
+	"github.com/go-stomp/stomp"
+)
+
+// headerPrefetchSize is how many unacked messages activemq sends a subscription before waiting for acks
+const headerPrefetchSize = "activemq.prefetchSize"
+
+// job is a message being converted by a worker, done is closed once doc, reason and err are set
+type job struct {
+	msg      *stomp.Message
+	settings *Queue // conversion settings as of when the message arrived, see Reconfigure
+	doc      document
+	reason   string
+	err      error
+	done     chan struct{}
+}
+
+// workers is how many messages are converted at once
+func (q *Queue) workers() int {
+	if q.Workers < 1 {
+		return 1
+	}
+	return q.Workers
+}
+
+// window is how many messages can be received and not yet written, enough for every worker to have
+// the next message ready while the oldest waits its turn to be written
+func (q *Queue) window() int {
+	return 2 * q.workers()
+}
+
+// startWorkers converts jobs until the channel is closed
+func (q *Queue) startWorkers(jobs <-chan *job) {
+	for i := 0; i < q.workers(); i++ {
+		go func() {
+			for j := range jobs {
+				j.doc, j.reason, j.err = j.settings.convert(j.msg)
+				close(j.done)
+			}
+		}()
+	}
+}
+
+// newJob queues a message for conversion with a copy of the current settings, so a Reconfigure
+// applies to the messages received after it, not to the ones already being converted
+func (q *Queue) newJob(msg *stomp.Message) *job {
+	q.settings.Lock()
+	defer q.settings.Unlock()
+	return &job{
+		msg: msg,
+		settings: &Queue{
+			Handlers:          q.Handlers,
+			Decoder:           q.Decoder,
+			ContentTypeHeader: q.ContentTypeHeader,
+			Topic:             q.Topic,
+			Headers:           q.Headers,
+			Key:               q.Key,
+			TimeSource:        q.TimeSource,
+			TimePath:          q.TimePath,
+			TimeHeader:        q.TimeHeader,
+			TimeLayout:        q.TimeLayout,
+		},
+		done: make(chan struct{}),
+	}
+}
@@ -0,0 +1,73 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+	"github.com/jeks313/activemq-archiver/internal/stomptest"
+	"github.com/tidwall/gjson"
+)
+
+func Test_ConsumeWorkers(t *testing.T) {
+	var messages []*frame.Frame
+	var want []string
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("m-%d", i)
+		m := frame.New(frame.MESSAGE, frame.Destination, "/queue/Consumer.Archive.VirtualTopic.Usage",
+			frame.MessageId, id, frame.Ack, id, "x-content-type", "slow")
+		m.Body = []byte(fmt.Sprintf(`{"n":%d,"account":"a%d"}`, i, i%3))
+		messages = append(messages, m)
+		want = append(want, id)
+	}
+	b := stomptest.Start(t, &stomptest.Broker{Messages: messages})
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := New()
+	q.Ctx = ctx
+	q.Topic = "Usage"
+	q.Key = "account"
+	q.ContentTypeHeader = "x-content-type"
+	q.Workers = 4
+	q.Prefetch = 8
+	q.Handlers["slow"] = func(data []byte) ([]byte, error) {
+		// the earlier messages take longest so they finish out of order
+		time.Sleep(time.Duration(20-gjson.GetBytes(data, "n").Int()) * time.Millisecond)
+		return data, nil
+	}
+	if err := q.Connect(b.Addr()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer q.Close()
+	if err := q.Subscribe(q.Topic); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if got := b.Next(t, frame.SUBSCRIBE).Header.Get(headerPrefetchSize); got != "8" {
+		t.Errorf("expected the subscription to have a prefetch of 8, got %q", got)
+	}
+	sink := &recordingSink{}
+	done := make(chan error)
+	go func() { done <- q.Consume(sink) }()
+
+	for i, id := range want {
+		if got := b.Next(t, frame.ACK).Header.Get(frame.Id); got != id {
+			t.Fatalf("expected ack %d to be for %v, got %v", i, id, got)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Consume() error = %v", err)
+	}
+	if len(sink.docs) != len(want) {
+		t.Fatalf("expected %d documents, got %d", len(want), len(sink.docs))
+	}
+	for i, doc := range sink.docs {
+		if n := gjson.Get(doc, "n").Int(); n != int64(i) {
+			t.Errorf("expected document %d to be message %d, got %v", i, i, doc)
+		}
+	}
+}
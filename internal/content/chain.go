@@ -0,0 +1,129 @@
+package content
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Decoder turns a payload into the next stage of its content type, and finally into JSON
+type Decoder func([]byte) ([]byte, error)
+
+// ErrUnknownStage is when a content type names a stage there's no decoder for
+var ErrUnknownStage = errors.New("unknown content type stage")
+
+// stages decode one layer of a payload each, by name in an x-content-type chain
+var stages = map[string]Decoder{
+	"b64":     decodeBase64,
+	"b64url":  decodeBase64URL,
+	"gzip":    gunzip,
+	"zlib":    inflateZlib,
+	"deflate": inflate,
+	"zstd":    unzstd,
+	"zip":     unzipFirstFile,
+	"json":    func(data []byte) ([]byte, error) { return data, nil }, // already JSON, checked when the headers are merged in
+}
+
+// Stages lists the stage names a content type can be made of
+func Stages() []string {
+	var names []string
+	for name := range stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse composes a decoder for an x-content-type value, the stages separated by ; and listed outermost
+// first, so b64;gzip;json is base64 decoded and then gunzipped, json can only be the last stage
+func Parse(contentType string) (Decoder, error) {
+	var names []string
+	var chain []Decoder
+	for _, name := range strings.Split(contentType, ";") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if len(names) > 0 && names[len(names)-1] == "json" {
+			return nil, fmt.Errorf("%v: json must be the last stage", contentType)
+		}
+		stage, ok := stages[name]
+		if !ok {
+			return nil, fmt.Errorf("%w %q in %v, known stages are %v", ErrUnknownStage, name, contentType, Stages())
+		}
+		names = append(names, name)
+		chain = append(chain, stage)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%w: empty content type", ErrUnknownStage)
+	}
+	return func(data []byte) ([]byte, error) {
+		var err error
+		for i, stage := range chain {
+			data, err = stage(data)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", names[i], err)
+			}
+		}
+		return data, nil
+	}, nil
+}
+
+func decodeBase64URL(data []byte) ([]byte, error) {
+	return decodeBase64With(base64.URLEncoding, base64.RawURLEncoding, data)
+}
+
+// decodeBase64With decodes padded or, when the length says padding was left off, unpadded base64,
+// ignoring surrounding whitespace
+func decodeBase64With(padded, raw *base64.Encoding, data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	encoding := padded
+	if len(data)%4 != 0 && !bytes.ContainsAny(data, "\r\n") {
+		encoding = raw
+	}
+	out := make([]byte, encoding.DecodedLen(len(data)))
+	n, err := encoding.Decode(out, data)
+	return out[:n], err
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func inflateZlib(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func unzstd(data []byte) ([]byte, error) {
+	r, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
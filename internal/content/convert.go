@@ -8,7 +8,7 @@ import (
 	"io/ioutil"
 )
 
-// X-Content-Type, zip;json, b64;zip;json
+// X-Content-Type, zip;json, b64;zip;json, any other chain of stages is composed by Parse
 
 // HandlerFromZipJSON decodes a payload containing a pkzip file with a single JSON file inside
 func HandlerFromZipJSON(data []byte) ([]byte, error) {
@@ -25,12 +25,7 @@ func HandlerFromBase64ZipJSON(data []byte) ([]byte, error) {
 }
 
 func decodeBase64(data []byte) ([]byte, error) {
-	var out = make([]byte, base64.StdEncoding.DecodedLen(len(data)))
-	_, err := base64.StdEncoding.Decode(out, data)
-	if err != nil {
-		return out, err
-	}
-	return out, nil
+	return decodeBase64With(base64.StdEncoding, base64.RawStdEncoding, data)
 }
 
 func unzipFirstFile(data []byte) ([]byte, error) {
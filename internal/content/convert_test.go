@@ -1,9 +1,18 @@
 package content
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"io"
 	"io/ioutil"
 	"reflect"
 	"testing"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 func Test_HandlerFromZipJSON(t *testing.T) {
@@ -123,3 +132,63 @@ func Test_unzipFirstFile(t *testing.T) {
 		})
 	}
 }
+
+func Test_Parse(t *testing.T) {
+	doc := []byte(`{"one": 1, "two": 2}`)
+	compress := func(w func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		c := w(&buf)
+		c.Write(doc)
+		c.Close()
+		return buf.Bytes()
+	}
+	gzipped := compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	zlibbed := compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })
+	deflated := compress(func(w io.Writer) io.WriteCloser { c, _ := flate.NewWriter(w, flate.DefaultCompression); return c })
+	zstded := compress(func(w io.Writer) io.WriteCloser { c, _ := zstd.NewWriter(w); return c })
+	zipped, err := ioutil.ReadFile("tests/webUsage.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		want        []byte
+		wantErr     bool
+	}{
+		{name: "json", contentType: "json", data: doc, want: doc},
+		{name: "base64 gzip", contentType: "b64;gzip;json", data: []byte(base64.StdEncoding.EncodeToString(gzipped)), want: doc},
+		{name: "unpadded base64url zlib", contentType: "b64url;zlib;json", data: []byte(base64.RawURLEncoding.EncodeToString(zlibbed)), want: doc},
+		{name: "deflate", contentType: "deflate;json", data: deflated, want: doc},
+		{name: "zstd", contentType: "zstd;json", data: zstded, want: doc},
+		{name: "base64 zip", contentType: "b64;zip;json", data: []byte(base64.StdEncoding.EncodeToString(zipped)), want: []byte("{\"one\": 1, \"two\": 2}\n")},
+		{name: "case and spaces", contentType: " B64 ; GZIP; json", data: []byte(base64.StdEncoding.EncodeToString(gzipped)), want: doc},
+		{name: "base64 twice", contentType: "b64;b64;gzip", data: []byte(base64.StdEncoding.EncodeToString([]byte(base64.StdEncoding.EncodeToString(gzipped)))), want: doc},
+		{name: "corrupt gzip", contentType: "gzip;json", data: doc, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decode, err := Parse(tt.contentType)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			got, err := decode(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, tt.want) {
+				t.Errorf("decode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	for _, contentType := range []string{"", ";", "rar;json", "json;gzip"} {
+		if _, err := Parse(contentType); err == nil {
+			t.Errorf("Parse(%q) expected an error", contentType)
+		}
+	}
+	if _, err := Parse("b64;rar;json"); !errors.Is(err, ErrUnknownStage) {
+		t.Errorf("expected an unknown stage error, got %v", err)
+	}
+}
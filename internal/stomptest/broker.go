@@ -0,0 +1,140 @@
+// Package stomptest is a stub STOMP broker for testing the code that talks to ActiveMQ
+package stomptest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+// Broker is enough of a STOMP broker to check the frames a client sends, it answers CONNECT
+// and receipts and passes every frame it reads to Frames
+type Broker struct {
+	Frames    chan *frame.Frame
+	Heartbeat time.Duration        // heartbeat interval offered in CONNECTED and sent at once connected, 0 is never
+	Silent    bool                 // offer heartbeats but never send them
+	Mute      bool                 // accept connections but never answer, like a broker behind a stuck load balancer
+	Messages  []*frame.Frame       // MESSAGE frames sent on subscribe, the subscription header is filled in
+	Seen      func(f *frame.Frame) // called with every frame as it is read, before it is answered
+	listener  net.Listener
+}
+
+// Start serves the broker on a local port until Close, its settings can't change once started
+func Start(t *testing.T, b *Broker) *Broker {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return StartListener(b, l)
+}
+
+// StartListener serves the broker on a listener, such as a TLS one, until Close
+func StartListener(b *Broker, l net.Listener) *Broker {
+	b.listener, b.Frames = l, make(chan *frame.Frame, 100)
+	go b.serve()
+	return b
+}
+
+// Addr is the address the broker listens on
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Close stops accepting connections
+func (b *Broker) Close() {
+	b.listener.Close()
+}
+
+// Next is the next frame with the command, skipping others
+func (b *Broker) Next(t *testing.T, command string) *frame.Frame {
+	t.Helper()
+	for f := range b.Frames {
+		if f.Command == command {
+			return f
+		}
+	}
+	t.Fatalf("broker closed before a %v frame", command)
+	return nil
+}
+
+func (b *Broker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	r, w := frame.NewReader(conn), frame.NewWriter(conn)
+	var writing sync.Mutex
+	write := func(f *frame.Frame) error {
+		writing.Lock()
+		defer writing.Unlock()
+		return w.Write(f)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	heartbeats := func() {
+		if b.Heartbeat <= 0 || b.Silent {
+			return
+		}
+		go func() {
+			ticker := time.NewTicker(b.Heartbeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if write(nil) != nil {
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	for {
+		f, err := r.Read()
+		if err != nil {
+			return
+		}
+		if f == nil { // heart-beat
+			continue
+		}
+		if b.Seen != nil {
+			b.Seen(f)
+		}
+		b.Frames <- f
+		if b.Mute {
+			continue
+		}
+		switch {
+		case f.Command == frame.CONNECT || f.Command == frame.STOMP:
+			heartbeat := fmt.Sprintf("%d,0", b.Heartbeat/time.Millisecond)
+			err = write(frame.New(frame.CONNECTED, frame.Version, "1.2", frame.HeartBeat, heartbeat))
+			heartbeats()
+		case f.Command == frame.SUBSCRIBE:
+			for _, m := range b.Messages {
+				m = m.Clone()
+				m.Header.Set(frame.Subscription, f.Header.Get(frame.Id))
+				if err = write(m); err != nil {
+					return
+				}
+			}
+		case f.Header.Get(frame.Receipt) != "":
+			err = write(frame.New(frame.RECEIPT, frame.ReceiptId, f.Header.Get(frame.Receipt)))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package upload
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uploadsCompleted = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "uploads_completed_count",
+			Help:      "Number of archive files uploaded and verified",
+		},
+	)
+	uploadsFailed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "uploads_failed_count",
+			Help:      "Number of failed archive file upload attempts",
+		},
+	)
+	uploadedBytes = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "uploaded_bytes",
+			Help:      "Number of archive file bytes uploaded",
+		},
+	)
+	uploadsQueued = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "uploads_queued",
+			Help:      "Number of archive files waiting to be uploaded",
+		},
+	)
+	uploadsKeyTaken = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "absolute",
+			Subsystem: "activemq_archiver",
+			Name:      "uploads_key_taken_count",
+			Help:      "Number of archive files uploaded under a suffixed key as an object already had theirs",
+		},
+	)
+)
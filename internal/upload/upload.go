@@ -0,0 +1,414 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/rs/zerolog/log"
+)
+
+// What to do with the local file once it has been uploaded and verified
+const (
+	AfterUploadDelete = "delete"
+	AfterUploadMove   = "move"
+	AfterUploadKeep   = "keep"
+)
+
+// Options configures the S3 compatible uploader
+type Options struct {
+	Endpoint      string        // S3 compatible endpoint, e.g. http://localhost:9000, empty uses AWS
+	Region        string        // bucket region
+	Bucket        string        // bucket to upload to
+	Prefix        string        // key prefix, the path of the file relative to Root is appended
+	AccessKey     string        // static credentials, the default AWS credential chain is used when empty
+	SecretKey     string        // static credentials
+	PathStyle     bool          // use path style addressing, needed by most S3 compatible stores
+	Root          string        // directory completed archives are found in
+	ScanOnStart   bool          // queue files left in Root by a previous run, only safe if Root holds nothing but completed files
+	PartSize      int64         // multipart upload part size, files larger than this are uploaded in parts
+	Retries       int           // number of attempts per file before it is put back on the queue
+	RetryDelay    time.Duration // delay before the first retry, doubled on each attempt
+	MaxRetryDelay time.Duration // longest wait before a file put back on the queue is tried again, defaults to 5m
+	DrainTimeout  time.Duration // how long the files still queued once Run is cancelled are tried for, defaults to 30s
+	AfterUpload   string        // delete, move or keep the local file after a verified upload
+	MovePath      string        // where uploaded files are moved to with AfterUploadMove
+}
+
+// Uploader ships completed archive files to an S3 compatible store
+type Uploader struct {
+	opts     Options
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	mu       sync.Mutex
+	queue    []*queued     // files waiting to be uploaded, in the order they were queued
+	wake     chan struct{} // signalled when a file is queued
+	wg       sync.WaitGroup
+}
+
+// queued is a file waiting to be uploaded
+type queued struct {
+	filename string
+	key      string    // object key picked by the first attempt, so retries replace their own upload
+	attempts int       // times put back on the queue after failing
+	due      time.Time // not tried again before this
+}
+
+// New creates an uploader, call Run once to start processing queued files
+func New(opts Options) (*Uploader, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("upload: bucket is required")
+	}
+	if opts.PartSize < s3manager.MinUploadPartSize {
+		opts.PartSize = s3manager.MinUploadPartSize
+	}
+	if opts.Retries < 1 {
+		opts.Retries = 1
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = time.Second
+	}
+	if opts.MaxRetryDelay <= 0 {
+		opts.MaxRetryDelay = 5 * time.Minute
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = 30 * time.Second
+	}
+	switch opts.AfterUpload {
+	case "":
+		opts.AfterUpload = AfterUploadDelete
+	case AfterUploadDelete, AfterUploadKeep:
+	case AfterUploadMove:
+		if opts.MovePath == "" {
+			return nil, fmt.Errorf("upload: move path is required to move uploaded files")
+		}
+	default:
+		return nil, fmt.Errorf("upload: unknown after upload action: %v", opts.AfterUpload)
+	}
+	cfg := aws.NewConfig().WithS3ForcePathStyle(opts.PathStyle)
+	if opts.Region != "" {
+		cfg = cfg.WithRegion(opts.Region)
+	}
+	if opts.Endpoint != "" {
+		cfg = cfg.WithEndpoint(opts.Endpoint)
+	}
+	if opts.AccessKey != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(opts.AccessKey, opts.SecretKey, ""))
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	u := &Uploader{opts: opts}
+	u.client = s3.New(sess)
+	u.uploader = s3manager.NewUploaderWithClient(u.client, func(up *s3manager.Uploader) {
+		up.PartSize = opts.PartSize
+	})
+	u.wake = make(chan struct{}, 1)
+	u.wg.Add(1) // done when Run returns, so Wait can't miss a Run that hasn't started yet
+	return u, nil
+}
+
+// Upload queues a completed archive file for upload, it never blocks
+func (u *Uploader) Upload(filename string) {
+	u.push(&queued{filename: filename})
+}
+
+func (u *Uploader) push(f *queued) {
+	u.mu.Lock()
+	u.queue = append(u.queue, f)
+	uploadsQueued.Set(float64(len(u.queue)))
+	u.mu.Unlock()
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the first file that is due, or says how long until one is, 0 when the queue is empty
+func (u *Uploader) next(now time.Time) (*queued, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var wait time.Duration
+	for i, f := range u.queue {
+		if !f.due.After(now) {
+			u.queue = append(u.queue[:i], u.queue[i+1:]...)
+			uploadsQueued.Set(float64(len(u.queue)))
+			return f, 0
+		}
+		if d := f.due.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+// Run uploads queued files until the context is cancelled, anything already in
+// the queue is tried for up to the drain timeout. Failed files go back on the queue.
+func (u *Uploader) Run(ctx context.Context) {
+	defer u.wg.Done()
+	go u.backlog()
+	for ctx.Err() == nil {
+		f, wait := u.next(time.Now())
+		if f != nil {
+			u.attempt(ctx, f)
+			continue
+		}
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			retry = timer.C
+		}
+		select {
+		case <-u.wake:
+		case <-retry:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	u.mu.Lock()
+	remaining := u.queue
+	u.queue = nil
+	uploadsQueued.Set(0)
+	u.mu.Unlock()
+	drain, cancel := context.WithTimeout(context.Background(), u.opts.DrainTimeout)
+	defer cancel()
+	for _, f := range remaining {
+		if err := u.uploadFile(drain, f); err != nil {
+			log.Error().Err(err).Str("filename", f.filename).Msg("upload: failed to upload file on shutdown, left in place")
+		}
+	}
+	log.Info().Msg("upload: stopped")
+}
+
+// attempt uploads a file, putting it back on the queue with an increasing delay if that fails
+func (u *Uploader) attempt(ctx context.Context, f *queued) {
+	err := u.uploadFile(ctx, f)
+	if err == nil {
+		return
+	}
+	if ctx.Err() == nil {
+		f.attempts++
+	}
+	delay := u.opts.MaxRetryDelay
+	if f.attempts < 32 && u.opts.RetryDelay<<uint(f.attempts) < delay {
+		delay = u.opts.RetryDelay << uint(f.attempts)
+	}
+	f.due = time.Now().Add(delay)
+	log.Error().Err(err).Str("filename", f.filename).Int("attempts", f.attempts).Dur("retry_in", delay).Msg("upload: giving up for now, queued again")
+	u.push(f)
+}
+
+// Wait blocks until Run has returned
+func (u *Uploader) Wait() {
+	u.wg.Wait()
+}
+
+// backlog queues completed files that were not uploaded before the last shutdown
+func (u *Uploader) backlog() {
+	if u.opts.Root == "" || !u.opts.ScanOnStart {
+		return
+	}
+	err := filepath.Walk(u.opts.Root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(filename, ".tmp") {
+			return nil
+		}
+		if u.opts.AfterUpload == AfterUploadKeep { // we can't tell what was already uploaded
+			return nil
+		}
+		log.Info().Str("filename", filename).Msg("upload: queueing file from previous run")
+		u.Upload(filename)
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Str("root", u.opts.Root).Msg("upload: failed to scan for files to upload")
+	}
+}
+
+// UploadFile uploads, verifies and then removes or moves a single file, retrying with
+// an increasing delay on failure
+func (u *Uploader) UploadFile(ctx context.Context, filename string) error {
+	return u.uploadFile(ctx, &queued{filename: filename})
+}
+
+func (u *Uploader) uploadFile(ctx context.Context, f *queued) error {
+	filename := f.filename
+	if _, err := os.Stat(filename); os.IsNotExist(err) { // already uploaded, e.g. queued twice on startup
+		log.Debug().Str("filename", filename).Msg("upload: file no longer exists, skipping")
+		return nil
+	}
+	if f.key == "" {
+		key, err := u.freeKey(ctx, u.Key(filename))
+		if err != nil {
+			uploadsFailed.Inc()
+			return err
+		}
+		f.key = key
+	}
+	key := f.key
+	logger := log.With().Str("filename", filename).Str("bucket", u.opts.Bucket).Str("key", key).Logger()
+	delay := u.opts.RetryDelay
+	var err error
+	for attempt := 1; attempt <= u.opts.Retries; attempt++ {
+		err = u.upload(ctx, filename, key)
+		if err == nil {
+			break
+		}
+		logger.Error().Err(err).Int("attempt", attempt).Msg("upload: failed to upload file")
+		uploadsFailed.Inc()
+		if attempt == u.opts.Retries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = delay * 2
+	}
+	logger.Info().Msg("upload: uploaded file")
+	uploadsCompleted.Inc()
+	return u.cleanup(filename)
+}
+
+// freeKey is the key, or when an object already has it, e.g. the same part uploaded by an earlier
+// run in the same hour, the first free key with a -N suffix
+func (u *Uploader) freeKey(ctx context.Context, key string) (string, error) {
+	candidate := key
+	for n := 1; ; n++ {
+		_, err := u.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(u.opts.Bucket),
+			Key:    aws.String(candidate),
+		})
+		if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+			if candidate != key {
+				log.Warn().Str("key", key).Str("free_key", candidate).Msg("upload: key already taken, uploading under a new key")
+				uploadsKeyTaken.Inc()
+			}
+			return candidate, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to check for an existing object: %v", err)
+		}
+		candidate = suffixKey(key, n)
+	}
+}
+
+// archiveExtensions are kept at the end of suffixed keys so the format can still be told from the key
+var archiveExtensions = []string{".log.gz", ".log.zst", ".log", ".parquet"}
+
+// suffixKey adds -n to the key before its archive extension
+func suffixKey(key string, n int) string {
+	ext := path.Ext(key)
+	for _, e := range archiveExtensions {
+		if strings.HasSuffix(key, e) {
+			ext = e
+			break
+		}
+	}
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(key, ext), n, ext)
+}
+
+func (u *Uploader) upload(ctx context.Context, filename, key string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = u.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(u.opts.Bucket),
+		Key:    aws.String(key),
+		Body:   f,
+	})
+	if err != nil {
+		return err
+	}
+	head, err := u.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(u.opts.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify upload: %v", err)
+	}
+	if aws.Int64Value(head.ContentLength) != info.Size() {
+		return fmt.Errorf("failed to verify upload: uploaded size %d, local size %d", aws.Int64Value(head.ContentLength), info.Size())
+	}
+	uploadedBytes.Add(float64(info.Size()))
+	return nil
+}
+
+func (u *Uploader) cleanup(filename string) error {
+	switch u.opts.AfterUpload {
+	case AfterUploadDelete:
+		err := os.Remove(filename)
+		if err != nil {
+			log.Error().Err(err).Str("filename", filename).Msg("upload: failed to remove uploaded file")
+			return err
+		}
+		u.removeEmptyDirs(filepath.Dir(filename))
+		return nil
+	case AfterUploadMove:
+		moved := filepath.Join(u.opts.MovePath, u.relative(filename))
+		err := os.MkdirAll(filepath.Dir(moved), 0755)
+		if err == nil {
+			err = os.Rename(filename, moved)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("filename", filename).Str("moved_filename", moved).Msg("upload: failed to move uploaded file")
+			return err
+		}
+		u.removeEmptyDirs(filepath.Dir(filename))
+	}
+	return nil
+}
+
+// removeEmptyDirs tidies up partition directories under Root left empty by uploaded files
+func (u *Uploader) removeEmptyDirs(dir string) {
+	if u.opts.Root == "" {
+		return
+	}
+	root := filepath.Clean(u.opts.Root)
+	for strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Key is the object key for a file, the prefix followed by the path of the file relative
+// to Root, so the object keys mirror the archive file layout
+func (u *Uploader) Key(filename string) string {
+	return path.Join(u.opts.Prefix, filepath.ToSlash(u.relative(filename)))
+}
+
+func (u *Uploader) relative(filename string) string {
+	if u.opts.Root != "" {
+		if rel, err := filepath.Rel(u.opts.Root, filename); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return filepath.Base(filename)
+}
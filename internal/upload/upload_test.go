@@ -0,0 +1,305 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubS3 is a minimal in memory S3 compatible store, enough for put, multipart and head
+type stubS3 struct {
+	sync.Mutex
+	objects   map[string][]byte
+	parts     map[string]map[int][]byte
+	failPuts  int // number of uploads to fail before accepting
+	multipart int // number of completed multipart uploads
+}
+
+func newStubS3() *stubS3 {
+	return &stubS3{objects: make(map[string][]byte), parts: make(map[string]map[int][]byte)}
+}
+
+func (s *stubS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	q := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	_, initiate := q["uploads"]
+	switch {
+	case r.Method == http.MethodHead:
+		obj, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		s.parts[q.Get("uploadId")][n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case r.Method == http.MethodPut:
+		if s.failPuts > 0 {
+			s.failPuts--
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Error><Code>BadDigest</Code><Message>stub failure</Message></Error>`)
+			return
+		}
+		s.objects[key] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+	case r.Method == http.MethodPost && initiate:
+		id := fmt.Sprintf("upload-%d", len(s.parts))
+		s.parts[id] = make(map[int][]byte)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		parts := s.parts[q.Get("uploadId")]
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var obj bytes.Buffer
+		for _, n := range numbers {
+			obj.Write(parts[n])
+		}
+		s.multipart++
+		s.objects[key] = obj.Bytes()
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`, key)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func Test_UploadFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		failPuts    int
+		afterUpload string
+		prefix      string
+		wantKey     string
+		multipart   int
+	}{
+		{
+			name:        "single put and delete",
+			size:        1024,
+			afterUpload: AfterUploadDelete,
+			prefix:      "archive/topic",
+			wantKey:     "bucket/archive/topic/sub/file.log",
+		},
+		{
+			name:        "multipart and move",
+			size:        11 * 1024 * 1024,
+			afterUpload: AfterUploadMove,
+			wantKey:     "bucket/sub/file.log",
+			multipart:   1,
+		},
+		{
+			name:        "retried and kept",
+			size:        10,
+			failPuts:    2,
+			afterUpload: AfterUploadKeep,
+			wantKey:     "bucket/sub/file.log",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "upload")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			root := filepath.Join(dir, "complete")
+			moved := filepath.Join(dir, "uploaded")
+			filename := filepath.Join(root, "sub", "file.log")
+			if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+				t.Fatal(err)
+			}
+			data := bytes.Repeat([]byte("x"), tt.size)
+			if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			stub := newStubS3()
+			stub.failPuts = tt.failPuts
+			srv := httptest.NewServer(stub)
+			defer srv.Close()
+			u, err := New(Options{
+				Endpoint:    srv.URL,
+				Region:      "us-east-1",
+				Bucket:      "bucket",
+				Prefix:      tt.prefix,
+				AccessKey:   "test",
+				SecretKey:   "test",
+				PathStyle:   true,
+				Root:        root,
+				Retries:     3,
+				RetryDelay:  time.Millisecond,
+				AfterUpload: tt.afterUpload,
+				MovePath:    moved,
+			})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			if err := u.UploadFile(context.Background(), filename); err != nil {
+				t.Fatalf("UploadFile() error = %v", err)
+			}
+			if got := stub.objects[tt.wantKey]; !bytes.Equal(got, data) {
+				t.Errorf("uploaded object %v has %d bytes, want %d", tt.wantKey, len(got), len(data))
+			}
+			if stub.multipart != tt.multipart {
+				t.Errorf("multipart uploads = %d, want %d", stub.multipart, tt.multipart)
+			}
+			_, err = os.Stat(filename)
+			if exists := err == nil; exists != (tt.afterUpload == AfterUploadKeep) {
+				t.Errorf("local file exists = %v after %v", exists, tt.afterUpload)
+			}
+			if tt.afterUpload == AfterUploadMove {
+				if _, err := os.Stat(filepath.Join(moved, "sub", "file.log")); err != nil {
+					t.Errorf("uploaded file was not moved: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func newTestUploader(t *testing.T, endpoint, root string) *Uploader {
+	t.Helper()
+	u, err := New(Options{
+		Endpoint:      endpoint,
+		Region:        "us-east-1",
+		Bucket:        "bucket",
+		AccessKey:     "test",
+		SecretKey:     "test",
+		PathStyle:     true,
+		Root:          root,
+		Retries:       1,
+		RetryDelay:    time.Millisecond,
+		MaxRetryDelay: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return u
+}
+
+func Test_UploadFileKeyTaken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stub := newStubS3()
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	filename := filepath.Join(dir, "topic=T_dt=2026-10-18T10:00Z_accountUID=a_part=00.log.gz")
+
+	// a restart in the same hour opens part 00 again as the first run's was deleted once uploaded
+	runs := []string{"first run", "second run", "third run"}
+	for _, run := range runs {
+		if err := ioutil.WriteFile(filename, []byte(run), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := newTestUploader(t, srv.URL, dir).UploadFile(context.Background(), filename); err != nil {
+			t.Fatalf("UploadFile() error = %v", err)
+		}
+	}
+	want := map[string]string{
+		"bucket/topic=T_dt=2026-10-18T10:00Z_accountUID=a_part=00.log.gz":   "first run",
+		"bucket/topic=T_dt=2026-10-18T10:00Z_accountUID=a_part=00-1.log.gz": "second run",
+		"bucket/topic=T_dt=2026-10-18T10:00Z_accountUID=a_part=00-2.log.gz": "third run",
+	}
+	for key, data := range want {
+		if got := string(stub.objects[key]); got != data {
+			t.Errorf("object %v = %q, want %q", key, got, data)
+		}
+	}
+}
+
+func Test_RunRequeuesFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stub := newStubS3()
+	stub.failPuts = 3
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	filename := filepath.Join(dir, "file.log")
+	if err := ioutil.WriteFile(filename, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u := newTestUploader(t, srv.URL, dir)
+	for i := 0; i < 2000; i++ { // more than the old queue held, queueing must not block
+		u.Upload(filename)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go u.Run(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stub.Lock()
+		got := string(stub.objects["bucket/file.log"])
+		stub.Unlock()
+		if got == "data" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("file was not uploaded after failing %d times", 3)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	u.Wait()
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("expected the uploaded file to be deleted, got %v", err)
+	}
+}
+
+func Test_RunDrainTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stub := newStubS3()
+	stub.failPuts = 1000
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	filename := filepath.Join(dir, "file.log")
+	if err := ioutil.WriteFile(filename, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u, err := New(Options{Endpoint: srv.URL, Region: "us-east-1", Bucket: "bucket", AccessKey: "test", SecretKey: "test", PathStyle: true, Root: dir, Retries: 10, RetryDelay: time.Second, DrainTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	waited := make(chan struct{})
+	go func() { // waiting before Run has started must still wait for it
+		u.Wait()
+		close(waited)
+	}()
+	u.Upload(filename)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // shutting down, so the queued file is only tried for the drain timeout
+	go u.Run(ctx)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() kept retrying past the drain timeout")
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("expected the file that failed to upload to be left in place: %v", err)
+	}
+}
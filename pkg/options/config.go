@@ -0,0 +1,160 @@
+package options
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envVar matches the ${VAR} references expanded in config values, a bare $ is left alone
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Config is a pipelines config file, settings a pipeline leaves out fall back to the command line options
+type Config struct {
+	Pipelines []Pipeline `yaml:"pipelines"`
+}
+
+// Pipeline is a source of messages, how they are decoded and where the documents are written to
+type Pipeline struct {
+	Name       string     `yaml:"name"`
+	Source     Source     `yaml:"source"`
+	Key        string     `yaml:"key"`      // JSON path of the value to partition the archives on
+	Headers    []string   `yaml:"headers"`  // message headers merged into the payload
+	Handlers   []string   `yaml:"handlers"` // x-content-type values to decode, e.g. zip;json, any chain when empty
+	Transforms Transforms `yaml:"transforms"`
+	Sink       Sink       `yaml:"sink"`
+}
+
+// Source is where a pipeline consumes from
+type Source struct {
+	Destination      string `yaml:"destination"`       // topic name without the VirtualTopic part, or queue name, can be a wildcard
+	Subscription     string `yaml:"subscription"`      // virtual-topic, queue or durable-topic
+	Consumer         string `yaml:"consumer"`          // virtual topic consumer name, the X in Consumer.X.VirtualTopic
+	ClientID         string `yaml:"client-id"`         // connection client-id for a durable subscription
+	SubscriptionName string `yaml:"subscription-name"` // durable subscription name
+}
+
+// Transforms are applied to the documents before they are written
+type Transforms struct {
+	Time *EventTime `yaml:"time"` // partition by an event time instead of the arrival time
+}
+
+// EventTime is where the time a document is archived under comes from
+type EventTime struct {
+	Source string `yaml:"source"` // arrival, payload or header
+	Path   string `yaml:"path"`   // JSON path of the time in the payload
+	Header string `yaml:"header"` // header holding the time
+	Layout string `yaml:"layout"` // unix, unixms or a go time layout
+}
+
+// Sink is where the documents of a pipeline are archived
+type Sink struct {
+	ArchivePath      string `yaml:"archive-path"`
+	CompletePath     string `yaml:"complete-path"`
+	Layout           string `yaml:"layout"`
+	FilenameTemplate string `yaml:"filename-template"`
+	Format           string `yaml:"format"`
+	Compression      string `yaml:"compression"`
+	CompressionLevel int    `yaml:"compression-level"`
+	MaxSize          int    `yaml:"max-size"`
+}
+
+// LoadConfig reads a pipelines config file, ${VAR} in values is replaced with the environment variable
+// and an unset variable is an error, unknown fields are an error so typos don't silently fall back to defaults
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses and validates a pipelines config
+func ParseConfig(data []byte) (*Config, error) {
+	var c Config
+	err := yaml.UnmarshalStrict(data, &c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	err = expandEnv(reflect.ValueOf(&c).Elem())
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return &c, nil
+}
+
+// expandEnv replaces ${VAR} in every string value with the environment variable
+func expandEnv(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		var err error
+		s := envVar.ReplaceAllStringFunc(v.String(), func(ref string) string {
+			name := envVar.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %v is not set", name)
+			}
+			return value
+		})
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return expandEnv(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if err := expandEnv(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandEnv(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the pipelines are complete and don't clash, the subscription, time source and
+// handlers are checked by the caller along with the rest of the topic settings
+func (c *Config) Validate() error {
+	if len(c.Pipelines) == 0 {
+		return fmt.Errorf("no pipelines defined")
+	}
+	names := make(map[string]bool)
+	destinations := make(map[string]string)
+	for i := range c.Pipelines {
+		p := &c.Pipelines[i]
+		if p.Source.Destination == "" {
+			return fmt.Errorf("pipeline %d (%v): source destination is required", i+1, p.Name)
+		}
+		if p.Name == "" {
+			p.Name = p.Source.Destination
+		}
+		if names[p.Name] {
+			return fmt.Errorf("pipeline %v: defined more than once", p.Name)
+		}
+		names[p.Name] = true
+		if other, ok := destinations[p.Source.Destination]; ok {
+			return fmt.Errorf("pipeline %v: destination %v is already consumed by pipeline %v", p.Name, p.Source.Destination, other)
+		}
+		destinations[p.Source.Destination] = p.Name
+		if p.Sink.MaxSize < 0 || p.Sink.CompressionLevel < 0 {
+			return fmt.Errorf("pipeline %v: sink sizes and levels can't be negative", p.Name)
+		}
+	}
+	return nil
+}
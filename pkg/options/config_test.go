@@ -0,0 +1,86 @@
+package options
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	os.Setenv("TEST_ARCHIVE_ROOT", "/data")
+	defer os.Unsetenv("TEST_ARCHIVE_ROOT")
+	tests := []struct {
+		name    string
+		config  string
+		want    []Pipeline
+		wantErr bool
+	}{
+		{
+			name: "defaults and interpolation",
+			config: `
+pipelines:
+  - source:
+      destination: DeviceEvents
+    key: deviceUid
+    headers: [esn, deviceUid]
+    handlers: ["zip;json"]
+    transforms:
+      time:
+        source: payload
+        path: event.ts
+    sink:
+      archive-path: ${TEST_ARCHIVE_ROOT}/devices
+      filename-template: "{{ .Key }}-$HOST.log"
+      compression: gzip
+`,
+			want: []Pipeline{{
+				Name:       "DeviceEvents",
+				Source:     Source{Destination: "DeviceEvents"},
+				Key:        "deviceUid",
+				Headers:    []string{"esn", "deviceUid"},
+				Handlers:   []string{"zip;json"},
+				Transforms: Transforms{Time: &EventTime{Source: "payload", Path: "event.ts"}},
+				Sink:       Sink{ArchivePath: "/data/devices", FilenameTemplate: "{{ .Key }}-$HOST.log", Compression: "gzip"},
+			}},
+		},
+		{
+			name:    "unknown field",
+			config:  "pipelines:\n  - source:\n      destination: DeviceEvents\n    sink:\n      archive_path: /data\n",
+			wantErr: true,
+		},
+		{
+			name:    "no pipelines",
+			config:  "pipelines: []\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing destination",
+			config:  "pipelines:\n  - name: devices\n",
+			wantErr: true,
+		},
+		{
+			name:    "destination consumed twice",
+			config:  "pipelines:\n  - name: a\n    source: {destination: DeviceEvents}\n  - name: b\n    source: {destination: DeviceEvents}\n",
+			wantErr: true,
+		},
+		{
+			name:    "unset variable",
+			config:  "pipelines:\n  - source: {destination: DeviceEvents}\n    sink: {archive-path: ${TEST_ARCHIVE_UNSET}/devices}\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseConfig([]byte(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.Pipelines, tt.want) {
+				t.Errorf("ParseConfig() = %+v, want %+v", got.Pipelines, tt.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package options
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog/log"
@@ -38,3 +40,16 @@ func Environment(env string) {
 func LogVersion() {
 	log.Info().Str("version", Version).Str("build", Build).Msg("version variables")
 }
+
+// Secret is the value, or the contents of the file when one is given, e.g. a mounted kubernetes secret,
+// without trailing newlines
+func Secret(value, filename string) (string, error) {
+	if filename == "" {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
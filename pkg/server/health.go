@@ -2,6 +2,7 @@ package server
 
 import (
 	"database/sql"
+	"encoding/json"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
@@ -10,8 +11,16 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// Health sets up the default health router
-func Health(r *mux.Router, route string) {
+// Dynamic is a health custom data value worked out on each request, for settings that change while running
+type Dynamic func() interface{}
+
+// MarshalJSON encodes the current value
+func (d Dynamic) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d())
+}
+
+// Health sets up the default health router, customData is added to the /status/about response
+func Health(r *mux.Router, route string, customData map[string]interface{}) {
 	mydb, err := sql.Open("mysql", "system:tjmwauki@tcp(127.0.0.1:3306)/test")
 	if err != nil {
 		log.Error().Err(err).Msg("failed to connect to test database")
@@ -39,17 +48,22 @@ func Health(r *mux.Router, route string) {
 
 	// Set up any service injected customData for /status/about response.
 	// Values can be any valid JSON conversion and will override values set in about.json.
-	customData := make(map[string]interface{})
+	if customData == nil {
+		customData = make(map[string]interface{})
+	}
 	// Examples:
 	//
 	// String value
-	customData["a-string"] = "some-value"
+	// customData["a-string"] = "some-value"
 	//
 	// Number value
-	customData["a-number"] = 123
+	// customData["a-number"] = 123
 	//
 	// Boolean value
-	customData["a-bool"] = true
+	// customData["a-bool"] = true
+	//
+	// Worked out on each request
+	// customData["a-dynamic"] = Dynamic(func() interface{} { return time.Now() })
 	//
 	// Array
 	// customData["an-array"] = []string{"val1", "val2"}